@@ -0,0 +1,357 @@
+package cliby
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kballard/go-shellquote"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/coryb/cliby.v1/util"
+)
+
+// AddCommandAlias makes alias run command.  Both are full space separated
+// command paths, e.g. AddCommandAlias("issue new", "issue create").
+func (c *Cli) AddCommandAlias(alias, command string) {
+	if c.aliases == nil {
+		c.aliases = make(map[string]string)
+	}
+	c.aliases[strings.Join(strings.Fields(alias), " ")] = strings.Join(strings.Fields(command), " ")
+}
+
+func (c *Cli) GetCommandAliases() map[string]string {
+	return c.aliases
+}
+
+// commandAliases is implemented by Cli, other implementations of Interface
+// have no command aliases.
+type commandAliases interface {
+	GetCommandAliases() map[string]string
+}
+
+func getCommandAliases(i Interface) map[string]string {
+	if aliases, ok := i.(commandAliases); ok {
+		return aliases.GetCommandAliases()
+	}
+	return nil
+}
+
+// commandNames returns every name RunCommand can dispatch, including
+// aliases.
+func commandNames(i Interface) map[string]bool {
+	names := make(map[string]bool)
+	for name := range getCommands(i) {
+		names[name] = true
+	}
+	for name := range getHandlers(i) {
+		names[name] = true
+	}
+	for alias := range getCommandAliases(i) {
+		names[alias] = true
+	}
+	return names
+}
+
+// resolveCommand returns the command registered for command, which may be
+// an alias or an unambiguous prefix of each word of a command, e.g. "is cr"
+// for "issue create".  Unknown commands are returned unchanged.
+func resolveCommand(i Interface, command string) (string, error) {
+	aliases := getCommandAliases(i)
+	names := commandNames(i)
+	if names[command] {
+		if target, ok := aliases[command]; ok {
+			return target, nil
+		}
+		return command, nil
+	}
+	words := strings.Fields(command)
+	matches := make(map[string]bool)
+	for name := range names {
+		if prefixMatch(words, strings.Fields(name)) {
+			if target, ok := aliases[name]; ok {
+				name = target
+			}
+			matches[name] = true
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return command, nil
+	case 1:
+		for name := range matches {
+			return name, nil
+		}
+	}
+	return "", ambiguousCommand(command, matches)
+}
+
+func prefixMatch(words, name []string) bool {
+	if len(words) == 0 || len(words) != len(name) {
+		return false
+	}
+	for n, word := range words {
+		if !strings.HasPrefix(name[n], word) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameWords(a, b []string) bool {
+	return strings.Join(a, " ") == strings.Join(b, " ")
+}
+
+func ambiguousCommand(command string, matches map[string]bool) error {
+	names := make([]string, 0, len(matches))
+	for name := range matches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("Command %s is ambiguous, it could be: %s", command, strings.Join(names, ", "))
+}
+
+// expandArgs rewrites args before they are parsed by app: a leading config
+// alias is replaced by its expansion, and command words that are aliases or
+// unambiguous prefixes are replaced by the full command name.  A leading
+// unknown command with a plugin is bound to app so that it can be parsed.
+func expandArgs(i Interface, app *kingpin.Application, args []string) ([]string, error) {
+	model := app.Model()
+	configAliases := loadConfigAliases(i)
+	flags := make(map[string]*kingpin.FlagModel)
+	addFlags := func(group *kingpin.FlagGroupModel) {
+		for _, flag := range group.Flags {
+			flags["--"+flag.Name] = flag
+			if flag.Short != 0 {
+				flags["-"+string(flag.Short)] = flag
+			}
+		}
+	}
+	addFlags(model.FlagGroupModel)
+
+	expanded := make(map[string]bool)
+	group := model.CmdGroupModel
+	path := []string{}
+	out := make([]string, 0, len(args))
+	for n := 0; n < len(args); n++ {
+		arg := args[n]
+		if arg == "--" {
+			out = append(out, args[n:]...)
+			break
+		}
+		if strings.HasPrefix(arg, "-") && arg != "-" {
+			out = append(out, arg)
+			if flag, ok := flags[arg]; ok && !flag.IsBoolFlag() && n+1 < len(args) {
+				n++
+				out = append(out, args[n])
+			}
+			continue
+		}
+		if group == nil || len(group.Commands) == 0 {
+			out = append(out, arg)
+			continue
+		}
+		if expansion, ok := configAliases[arg]; ok && len(path) == 0 && !expanded[arg] && findCmdModel(group, arg) == nil {
+			log.Debugf("Expanding alias %s to %q", arg, expansion)
+			expanded[arg] = true
+			args = append(append(append([]string{}, args[:n]...), expansion...), args[n+1:]...)
+			n--
+			continue
+		}
+		if arg == "help" && len(path) == 0 && findCmdModel(group, arg) == nil {
+			// kingpin adds the help command when parsing
+			out = append(out, args[n:]...)
+			break
+		}
+		if len(path) == 0 && findCmdModel(group, arg) == nil {
+			if plugin := findPlugin(i, arg); plugin != "" {
+				// everything after the plugin name is passed to it as is
+				bindPlugin(i, app, arg, plugin)
+				out = append(append(out, arg, "--"), args[n+1:]...)
+				break
+			}
+		}
+		words, err := matchCommandWord(i, group, path, arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, word := range words {
+			cmd := findCmdModel(group, word)
+			if cmd == nil {
+				group = nil
+				break
+			}
+			path = append(path, cmd.Name)
+			addFlags(cmd.FlagGroupModel)
+			group = cmd.CmdGroupModel
+		}
+		out = append(out, words...)
+	}
+	return out, nil
+}
+
+func findCmdModel(group *kingpin.CmdGroupModel, name string) *kingpin.CmdModel {
+	for _, cmd := range group.Commands {
+		if cmd.Name == name {
+			return cmd
+		}
+		for _, alias := range cmd.Aliases {
+			if alias == name {
+				return cmd
+			}
+		}
+	}
+	return nil
+}
+
+// matchCommandWord returns the command words to use for arg at the command
+// path, resolving aliases added with AddCommandAlias and unambiguous prefixes
+// of the commands in group.
+func matchCommandWord(i Interface, group *kingpin.CmdGroupModel, path []string, arg string) ([]string, error) {
+	if findCmdModel(group, arg) != nil {
+		return []string{arg}, nil
+	}
+	aliases := make(map[string][]string)
+	for alias, target := range getCommandAliases(i) {
+		words, targetWords := strings.Fields(alias), strings.Fields(target)
+		if len(words) != len(path)+1 || len(targetWords) <= len(path) ||
+			!sameWords(path, words[:len(path)]) || !sameWords(path, targetWords[:len(path)]) {
+			continue
+		}
+		aliases[words[len(path)]] = targetWords[len(path):]
+	}
+	if words, ok := aliases[arg]; ok {
+		return words, nil
+	}
+
+	matches := make(map[string][]string)
+	for _, cmd := range group.Commands {
+		for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+			if strings.HasPrefix(name, arg) {
+				matches[cmd.Name] = []string{cmd.Name}
+			}
+		}
+	}
+	for alias, words := range aliases {
+		if strings.HasPrefix(alias, arg) {
+			matches[strings.Join(words, " ")] = words
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return unknownCommandWord(group, path, arg, aliases)
+	case 1:
+		for _, words := range matches {
+			return words, nil
+		}
+	}
+	names := make(map[string]bool)
+	for name := range matches {
+		names[strings.Join(append(append([]string{}, path...), name), " ")] = true
+	}
+	return nil, ambiguousCommand(strings.Join(append(append([]string{}, path...), arg), " "), names)
+}
+
+// unknownCommandWord returns an UnknownCommandError with the commands arg
+// could be a typo of.  arg is kept as is when group has a default command,
+// which arg could be an argument of, or when there is nothing to suggest,
+// leaving the error to kingpin.
+func unknownCommandWord(group *kingpin.CmdGroupModel, path []string, arg string, aliases map[string][]string) ([]string, error) {
+	names := []string{}
+	for _, cmd := range group.Commands {
+		if cmd.Default {
+			return []string{arg}, nil
+		}
+		if !cmd.Hidden {
+			names = append(names, append([]string{cmd.Name}, cmd.Aliases...)...)
+		}
+	}
+	for alias := range aliases {
+		names = append(names, alias)
+	}
+	suggestions := suggestCommands(arg, names)
+	if len(suggestions) == 0 {
+		return []string{arg}, nil
+	}
+	prefix := strings.Join(path, " ")
+	for n := range suggestions {
+		suggestions[n] = joinCommand(prefix, suggestions[n])
+	}
+	return nil, UnknownCommandError{Name: joinCommand(prefix, arg), Suggestions: suggestions}
+}
+
+func joinCommand(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + " " + name
+}
+
+// suggestCommands returns the names within a small edit distance of
+// command, or that command is a prefix or substring of, closest first.
+func suggestCommands(command string, names []string) []string {
+	if command == "" {
+		return nil
+	}
+	// one typo per three characters, so short commands only get suggestions
+	// one edit away
+	threshold := len(command) / 3
+	if threshold < 1 {
+		threshold = 1
+	}
+	distances := make(map[string]int)
+	for _, name := range names {
+		distance := util.EditDistance(command, name)
+		if distance <= threshold || strings.Contains(name, command) {
+			if d, ok := distances[name]; !ok || distance < d {
+				distances[name] = distance
+			}
+		}
+	}
+	suggestions := make([]string, 0, len(distances))
+	for name := range distances {
+		suggestions = append(suggestions, name)
+	}
+	sort.Slice(suggestions, func(a, b int) bool {
+		da, db := distances[suggestions[a]], distances[suggestions[b]]
+		if da != db {
+			return da < db
+		}
+		return suggestions[a] < suggestions[b]
+	})
+	return suggestions
+}
+
+// loadConfigAliases returns the aliases from the "aliases" key of the
+// configs, e.g.
+//
+//	aliases:
+//	  mine: list --assignee me
+//
+// Values are split like a shell would, or can be given as a list of
+// arguments.  Aliases from closer configs win, and "name!: null" removes an
+// alias defined further away.
+func loadConfigAliases(i Interface) map[string][]string {
+	aliases := make(map[string][]string)
+	for _, config := range configSections(i, "aliases") {
+		section, _ := config.data.(map[string]interface{})
+		for name, value := range section {
+			if _, ok := aliases[name]; ok {
+				continue
+			}
+			switch value := value.(type) {
+			case string:
+				words, err := shellquote.Split(value)
+				if err != nil {
+					log.Errorf("Invalid alias %s in %s: %s", name, config.file, err)
+					continue
+				}
+				aliases[name] = words
+			case []interface{}:
+				for _, word := range value {
+					aliases[name] = append(aliases[name], fmt.Sprint(word))
+				}
+			}
+		}
+	}
+	return aliases
+}
@@ -0,0 +1,452 @@
+package cliby
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/coryb/yaml.v2"
+)
+
+// AuthProvider adds credentials to the requests sent to a host.
+type AuthProvider interface {
+	// Authenticate adds credentials to req.
+	Authenticate(ctx context.Context, req *http.Request) error
+	// Refresh is called when a request is rejected with 401 Unauthorized, it
+	// returns true when the credentials were renewed and the request should be
+	// sent again.
+	Refresh(ctx context.Context, resp *http.Response) (bool, error)
+}
+
+type BasicAuth struct {
+	User     string
+	Password string
+}
+
+func (a *BasicAuth) Authenticate(ctx context.Context, req *http.Request) error {
+	req.SetBasicAuth(a.User, a.Password)
+	return nil
+}
+
+func (a *BasicAuth) Refresh(ctx context.Context, resp *http.Response) (bool, error) {
+	return false, nil
+}
+
+type BearerAuth struct {
+	Token string
+}
+
+func (a *BearerAuth) Authenticate(ctx context.Context, req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	return nil
+}
+
+func (a *BearerAuth) Refresh(ctx context.Context, resp *http.Response) (bool, error) {
+	return false, nil
+}
+
+// APIKeyAuth sends Key in the Header request header, X-API-Key by default.
+type APIKeyAuth struct {
+	Header string
+	Key    string
+}
+
+func (a *APIKeyAuth) Authenticate(ctx context.Context, req *http.Request) error {
+	header := a.Header
+	if header == "" {
+		header = "X-API-Key"
+	}
+	req.Header.Set(header, a.Key)
+	return nil
+}
+
+func (a *APIKeyAuth) Refresh(ctx context.Context, resp *http.Response) (bool, error) {
+	return false, nil
+}
+
+// OAuth2Auth sends a bearer access token fetched from TokenURL, with the
+// refresh_token grant when RefreshToken is set and the client_credentials
+// grant otherwise.  A new token is fetched when the token expires, or when a
+// request is rejected with 401 Unauthorized.  Client sends the token
+// requests, http.DefaultClient when nil.  When Credentials is set a new
+// refresh token is saved to it for Host and ClientID.
+type OAuth2Auth struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+	Scopes       []string
+	Client       *http.Client
+	Credentials  CredentialStore
+	Host         string
+
+	mu          sync.Mutex
+	accessToken string
+	expires     time.Time
+}
+
+func (a *OAuth2Auth) Authenticate(ctx context.Context, req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.accessToken == "" || (!a.expires.IsZero() && time.Now().After(a.expires)) {
+		if err := a.fetchToken(ctx); err != nil {
+			return err
+		}
+	}
+	req.Header.Set("Authorization", "Bearer "+a.accessToken)
+	return nil
+}
+
+func (a *OAuth2Auth) Refresh(ctx context.Context, resp *http.Response) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.fetchToken(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+type oauth2Token struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func (a *OAuth2Auth) fetchToken(ctx context.Context) error {
+	form := url.Values{}
+	if a.RefreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", a.RefreshToken)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	if len(a.Scopes) > 0 {
+		form.Set("scope", strings.Join(a.Scopes, " "))
+	}
+	req, err := http.NewRequest("POST", a.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ContentTypeForm)
+	req.Header.Set("Accept", ContentTypeJSON)
+	req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	log.Debugf("Fetching OAuth2 token from %s", a.TokenURL)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	token := oauth2Token{}
+	if err := DecodeResponse(resp, &token); err != nil {
+		return err
+	}
+	if token.AccessToken == "" {
+		return fmt.Errorf("No access_token in response from %s", a.TokenURL)
+	}
+	a.accessToken = token.AccessToken
+	a.expires = time.Time{}
+	if token.ExpiresIn > 0 {
+		a.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	if token.RefreshToken != "" && token.RefreshToken != a.RefreshToken {
+		a.RefreshToken = token.RefreshToken
+		if a.Credentials != nil {
+			a.saveRefreshToken()
+		}
+	}
+	return nil
+}
+
+func (a *OAuth2Auth) saveRefreshToken() {
+	query := Credential{Host: a.Host, Username: a.ClientID}
+	cred, err := a.Credentials.Get(query)
+	if _, ok := err.(CredentialNotFoundError); ok {
+		cred, err = query, nil
+	}
+	if err == nil {
+		cred.OAuthRefreshToken = a.RefreshToken
+		err = a.Credentials.Store(cred)
+	}
+	if err != nil {
+		log.Errorf("Failed to save refresh token for %s: %s", a.Host, err)
+	}
+}
+
+// AddAuthProvider sets the provider authenticating requests to host, which
+// is either a hostname or a hostname and port, prefixed with "http://" to
+// also authenticate requests without TLS.
+func (c *Cli) AddAuthProvider(host string, provider AuthProvider) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.auth == nil {
+		c.auth = make(map[string]AuthProvider)
+	}
+	c.auth[host] = provider
+}
+
+// GetAuthProvider returns the provider for host, preferring a provider for
+// the hostname and port over one for just the hostname.  Providers from the
+// "auth" section of the configs take precedence over providers added with
+// AddAuthProvider.
+//
+// Credentials are only sent over TLS: a host, or a host prefixed with
+// "https://", matches providers added for the host with or without the
+// scheme.  A host prefixed with "http://" only matches providers added with
+// that prefix, which opts the host in to credentials sent in the clear.
+func (c *Cli) GetAuthProvider(host string) AuthProvider {
+	c.mu.Lock()
+	configAuth := c.configAuth
+	c.mu.Unlock()
+	if configAuth == nil {
+		// read the configs and credentials without holding the lock
+		configAuth = loadConfigAuth(c, c.GetHttpClient(), c.GetCredentialStore())
+		c.mu.Lock()
+		if c.configAuth == nil {
+			c.configAuth = configAuth
+		}
+		configAuth = c.configAuth
+		c.mu.Unlock()
+	}
+	scheme, host := splitAuthHost(host)
+	hosts := []string{host}
+	if hostname := (&url.URL{Host: host}).Hostname(); hostname != host {
+		hosts = append(hosts, hostname)
+	}
+	keys := []string{}
+	for _, h := range hosts {
+		keys = append(keys, scheme+"://"+h)
+		if scheme == "https" {
+			keys = append(keys, h)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, providers := range []map[string]AuthProvider{configAuth, c.auth} {
+		for _, key := range keys {
+			if provider, ok := providers[key]; ok {
+				return provider
+			}
+		}
+	}
+	return nil
+}
+
+// splitAuthHost splits the scheme, https unless given, from host.
+func splitAuthHost(host string) (scheme, hostport string) {
+	if n := strings.Index(host, "://"); n >= 0 {
+		return strings.ToLower(host[:n]), host[n+len("://"):]
+	}
+	return "https", host
+}
+
+// RegisterAuthentication uses Basic authentication for hostname.
+func (c *Cli) RegisterAuthentication(hostname, user, password string) {
+	c.AddAuthProvider(hostname, &BasicAuth{User: user, Password: password})
+}
+
+// AuthConfig is an entry of the "auth" section of a config file, selecting
+// the provider for a host:
+//
+//	auth:
+//	  jira.example.com:
+//	    type: basic
+//	    user: bob
+//	    password: secret
+//	  api.example.com:8443:
+//	    type: oauth2
+//	    token-url: https://login.example.com/oauth/token
+//	    client-id: my-tool
+//	    client-secret: secret
+//	    scopes: [read, write]
+//	  http://localhost:8080:
+//	    type: bearer
+//	    token: dev
+//
+// Type is one of basic, bearer, api-key or oauth2.  Hosts are only sent
+// credentials over https unless the entry opts in to plain http with the
+// scheme, see GetAuthProvider.  The entry of the closest config wins.  Secrets left out of the config, the password, token, key,
+// client-secret and refresh-token, are read from the credential store for
+// the host, see CredentialStoreConfig.
+type AuthConfig struct {
+	Type         string   `json:"type" yaml:"type"`
+	User         string   `json:"user" yaml:"user"`
+	Password     string   `json:"password" yaml:"password"`
+	Token        string   `json:"token" yaml:"token"`
+	Header       string   `json:"header" yaml:"header"`
+	Key          string   `json:"key" yaml:"key"`
+	TokenURL     string   `json:"token-url" yaml:"token-url"`
+	ClientID     string   `json:"client-id" yaml:"client-id"`
+	ClientSecret string   `json:"client-secret" yaml:"client-secret"`
+	RefreshToken string   `json:"refresh-token" yaml:"refresh-token"`
+	Scopes       []string `json:"scopes" yaml:"scopes"`
+}
+
+// NewAuthProvider returns the provider for config, with client sending the
+// OAuth2 token requests.
+func NewAuthProvider(config AuthConfig, client *http.Client) (AuthProvider, error) {
+	switch config.Type {
+	case "basic":
+		return &BasicAuth{User: config.User, Password: config.Password}, nil
+	case "bearer":
+		return &BearerAuth{Token: config.Token}, nil
+	case "api-key":
+		return &APIKeyAuth{Header: config.Header, Key: config.Key}, nil
+	case "oauth2":
+		if config.TokenURL == "" {
+			return nil, fmt.Errorf("oauth2 requires token-url")
+		}
+		return &OAuth2Auth{
+			TokenURL:     config.TokenURL,
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RefreshToken: config.RefreshToken,
+			Scopes:       config.Scopes,
+			Client:       client,
+		}, nil
+	}
+	return nil, fmt.Errorf("Unknown auth type %q, expected basic, bearer, api-key or oauth2", config.Type)
+}
+
+// readSecrets reads the secrets missing from config from the credentials
+// stored for host.
+func (config *AuthConfig) readSecrets(store CredentialStore, host string) error {
+	query := Credential{Host: host}
+	switch config.Type {
+	case "basic":
+		if config.Password != "" {
+			return nil
+		}
+		query.Username = config.User
+	case "bearer":
+		if config.Token != "" {
+			return nil
+		}
+	case "api-key":
+		if config.Key != "" {
+			return nil
+		}
+	case "oauth2":
+		if config.ClientSecret != "" && config.RefreshToken != "" {
+			return nil
+		}
+		query.Username = config.ClientID
+	default:
+		return nil
+	}
+	cred, err := store.Get(query)
+	if _, ok := err.(CredentialNotFoundError); ok {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	switch config.Type {
+	case "basic":
+		config.Password = cred.Password
+		if config.User == "" {
+			config.User = cred.Username
+		}
+	case "bearer":
+		config.Token = cred.Password
+	case "api-key":
+		config.Key = cred.Password
+	case "oauth2":
+		if config.ClientSecret == "" {
+			config.ClientSecret = cred.Password
+		}
+		if config.RefreshToken == "" {
+			config.RefreshToken = cred.OAuthRefreshToken
+		}
+	}
+	return nil
+}
+
+// loadConfigAuth returns the providers from the "auth" section of the
+// configs by host.
+func loadConfigAuth(i Interface, client *http.Client, store CredentialStore) map[string]AuthProvider {
+	providers := make(map[string]AuthProvider)
+	for _, config := range configSections(i, "auth") {
+		section, _ := config.data.(map[string]interface{})
+		for host, entry := range section {
+			if _, ok := providers[host]; ok {
+				continue
+			}
+			authConfig := AuthConfig{}
+			content, err := yaml.Marshal(entry)
+			if err == nil {
+				err = yaml.Unmarshal(content, &authConfig)
+			}
+			_, credentialHost := splitAuthHost(host)
+			if err == nil {
+				if err := authConfig.readSecrets(store, credentialHost); err != nil {
+					log.Errorf("Failed to read credentials for %s: %s", host, err)
+				}
+			}
+			var provider AuthProvider
+			if err == nil {
+				provider, err = NewAuthProvider(authConfig, client)
+			}
+			if err != nil {
+				log.Errorf("Invalid auth for %s in %s: %s", host, config.file, err)
+				continue
+			}
+			if oauth, ok := provider.(*OAuth2Auth); ok {
+				oauth.Credentials, oauth.Host = store, credentialHost
+			}
+			providers[host] = provider
+		}
+	}
+	return providers
+}
+
+// authenticate sends req with the credentials of the provider for its host,
+// sending it once more when the provider renews its credentials after a 401
+// Unauthorized response.
+func (c *Cli) authenticate(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	provider := c.GetAuthProvider(req.URL.Scheme + "://" + req.URL.Host)
+	if provider == nil {
+		if req.URL.Scheme == "http" && c.GetAuthProvider(req.URL.Host) != nil {
+			log.Warningf("Not sending credentials for %s over plain http", req.URL.Host)
+		}
+		return send(req)
+	}
+	ctx := req.Context()
+	authReq := req.Clone(ctx)
+	if err := provider.Authenticate(ctx, authReq); err != nil {
+		return nil, fmt.Errorf("Failed to authenticate to %s: %s", req.URL.Host, err)
+	}
+	resp, err := send(authReq)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		// the body has been consumed and cannot be sent again
+		return resp, nil
+	}
+	if renewed, err := provider.Refresh(ctx, resp); err != nil {
+		log.Errorf("Failed to renew credentials for %s: %s", req.URL.Host, err)
+		return resp, nil
+	} else if !renewed {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	log.Debugf("Retrying %s %s with renewed credentials", req.Method, req.URL.String())
+	authReq = req.Clone(ctx)
+	if req.GetBody != nil {
+		if authReq.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	if err := provider.Authenticate(ctx, authReq); err != nil {
+		return nil, fmt.Errorf("Failed to authenticate to %s: %s", req.URL.Host, err)
+	}
+	return send(authReq)
+}
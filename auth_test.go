@@ -0,0 +1,118 @@
+package cliby
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAuthProviders(t *testing.T) {
+	tokens := 0
+	revoked := map[string]bool{"Bearer token-1": true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/token":
+			if user, secret, _ := r.BasicAuth(); user != "my-tool" || secret != "s3cret" {
+				http.Error(w, "bad client", http.StatusUnauthorized)
+				return
+			}
+			tokens++
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":3600,"refresh_token":"refresh-%d","grant":%q}`, tokens, tokens, r.Form.Get("grant_type"))
+			return
+		case "/oauth":
+			if revoked[r.Header.Get("Authorization")] {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s|%s|%s", r.Header.Get("Authorization"), r.Header.Get("X-Token"), body)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	testDir(t, `
+auth:
+  http://`+host+`:
+    type: api-key
+    header: X-Token
+    key: from-config
+  other.example.com:
+    type: unknown
+`)
+
+	get := func(cli *Cli, path, content string) string {
+		t.Helper()
+		resp, err := cli.Post(server.URL+path, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Sprintf("%d %s", resp.StatusCode, body)
+	}
+
+	cli := New("test")
+	cli.SetCookieFile("")
+	cli.RegisterAuthentication("http://127.0.0.1", "bob", "secret")
+	if got := get(cli, "/", "{}"); got != "200 |from-config|{}" {
+		t.Errorf("Expected config provider to take precedence, got %q", got)
+	}
+
+	cli = New("test")
+	cli.SetCookieFile("")
+	cli.SetOptions(map[string]interface{}{"config-file": ".test.d/missing.yml"})
+	cli.RegisterAuthentication("127.0.0.1", "bob", "secret")
+	cli.AddAuthProvider(host, &BearerAuth{Token: "abc"})
+	if expected := "200 ||{}"; get(cli, "/", "{}") != expected {
+		t.Errorf("Expected no credentials over plain http, got %q", get(cli, "/", "{}"))
+	}
+	if cli.GetAuthProvider(host) == nil || cli.GetAuthProvider("https://127.0.0.1") == nil {
+		t.Errorf("Expected providers for https")
+	}
+	cli.RegisterAuthentication("http://127.0.0.1", "bob", "secret")
+	if expected := "200 Basic Ym9iOnNlY3JldA==||{}"; get(cli, "/", "{}") != expected {
+		t.Errorf("Expected %q, got %q", expected, get(cli, "/", "{}"))
+	}
+	cli.AddAuthProvider("http://"+host, &BearerAuth{Token: "abc"})
+	if expected := "200 Bearer abc||{}"; get(cli, "/", "{}") != expected {
+		t.Errorf("Expected %q, got %q", expected, get(cli, "/", "{}"))
+	}
+
+	oauth := &OAuth2Auth{TokenURL: server.URL + "/token", ClientID: "my-tool", ClientSecret: "s3cret"}
+	cli.AddAuthProvider("http://"+host, oauth)
+	if expected := `200 Bearer token-2||{"id":1}`; get(cli, "/oauth", `{"id":1}`) != expected {
+		t.Errorf("Expected request to be retried with a new token, got tokens %d", tokens)
+	}
+	if tokens != 2 || oauth.RefreshToken != "refresh-2" {
+		t.Errorf("Expected the token to be refreshed once, got %d tokens and refresh token %q", tokens, oauth.RefreshToken)
+	}
+	if expected := `200 Bearer token-2||`; get(cli, "/", "") != expected {
+		t.Errorf("Expected the token to be reused")
+	}
+
+	revoked["Bearer token-2"] = true
+	oauth.ClientSecret = "wrong"
+	if got := get(cli, "/oauth", "{}"); got != "401 " {
+		t.Errorf("Expected 401 when the token cannot be renewed, got %q", got)
+	}
+
+	if _, err := NewAuthProvider(AuthConfig{Type: "oauth2"}, nil); err == nil {
+		t.Errorf("Expected oauth2 without token-url to fail")
+	}
+
+	// "host!: null" in a closer config removes the provider for host
+	os.Mkdir(".test.d/config.d", 0755)
+	ioutil.WriteFile(".test.d/config.d/10-auth.yml", []byte("auth:\n  http://"+host+"!: null\n"), 0644)
+	cli = New("test")
+	cli.SetCookieFile("")
+	if got := get(cli, "/", "{}"); got != "200 ||{}" {
+		t.Errorf("Expected the config provider to be removed, got %q", got)
+	}
+}
@@ -1,18 +1,19 @@
 package cliby
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
-	"unicode"
+	"sync"
+	"time"
 
-	"github.com/fatih/camelcase"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"gopkg.in/coryb/cliby.v1/util"
 	"gopkg.in/coryb/yaml.v2"
@@ -23,15 +24,43 @@ var log = logging.MustGetLogger("cliby")
 
 type Exit struct{ Code int }
 
+func (e Exit) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
 type Cli struct {
-	// cookieFile string
-	ua        *http.Client
-	commands  map[string]func() error
-	defaults  interface{}
-	options   interface{}
-	templates map[string]string
-	name      string
-	// authMap   map[string]string
+	cookieFile  string
+	jar         *CookieJar
+	ua          *http.Client
+	commands    map[string]func() error
+	defaults    interface{}
+	options     interface{}
+	templates   map[string]string
+	name        string
+	sources     map[string]ConfigSource
+	searched    []string
+	tree        map[string]*Command
+	handlers    map[string]Handler
+	aliases     map[string]string
+	completers  map[string]Completer
+	preRun      map[string][]Hook
+	postRun     map[string][]PostHook
+	streams     *IOStreams
+	auth        map[string]AuthProvider
+	configAuth  map[string]AuthProvider
+	credentials CredentialStore
+	// retryPolicy is loaded from the configs unless retryConfigured
+	retryPolicy     *RetryPolicy
+	retryConfigured bool
+	rateLimits      map[string]time.Time
+	// customCommands are the handlers added by bindCustomCommands
+	customCommands map[string]bool
+	// mu guards the HTTP state set up on the first request, the client,
+	// cookie jar, auth providers, credential store, retry policy and rate
+	// limits, so that requests can be sent concurrently.
+	mu *sync.Mutex
+	// configs holds the content and config-only keys of the configs
+	configs *configCache
 }
 
 type Options struct {
@@ -39,14 +68,15 @@ type Options struct {
 }
 
 func New(name string) *Cli {
-	// homedir := os.Getenv("HOME")
+	homedir := os.Getenv("HOME")
 
 	cli := &Cli{
-		// cookieFile: fmt.Sprintf("%s/.%s.d/cookies.js", homedir, name),
-		ua:       &http.Client{},
-		name:     name,
-		commands: make(map[string]func() error),
-		// authMap:    make(map[string]string),
+		cookieFile: fmt.Sprintf("%s/.%s.d/cookies.js", homedir, name),
+		ua:         &http.Client{},
+		name:       name,
+		commands:   make(map[string]func() error),
+		mu:         &sync.Mutex{},
+		configs:    &configCache{},
 	}
 
 	return cli
@@ -92,10 +122,56 @@ func (c *Cli) GetCommand(command string) func() error {
 	}
 }
 
+func (c *Cli) AddCommand(command string, fn func() error) {
+	if c.commands == nil {
+		c.commands = make(map[string]func() error)
+	}
+	c.commands[command] = fn
+}
+
+// commandAdder and commandLister are implemented by Cli, commands are added
+// to other implementations of Interface with SetCommands when they can list
+// their commands.
+type commandAdder interface {
+	AddCommand(string, func() error)
+}
+
+type commandLister interface {
+	GetCommands() map[string]func() error
+}
+
+func getCommands(i Interface) map[string]func() error {
+	if lister, ok := i.(commandLister); ok {
+		return lister.GetCommands()
+	}
+	return nil
+}
+
+func addCommand(i Interface, command string, fn func() error) {
+	if adder, ok := i.(commandAdder); ok {
+		adder.AddCommand(command, fn)
+		return
+	}
+	if _, ok := i.(commandLister); !ok {
+		log.Errorf("Cannot add command %s, %T has neither AddCommand nor GetCommands", command, i)
+		return
+	}
+	commands := make(map[string]func() error)
+	for name, run := range getCommands(i) {
+		commands[name] = run
+	}
+	commands[command] = fn
+	i.SetCommands(commands)
+}
+
 func (c *Cli) SetTemplates(templates map[string]string) {
 	c.templates = templates
 }
 
+func (c *Cli) GetTemplates() map[string]string {
+	return c.templates
+}
+
 func (c *Cli) GetTemplate(template string) string {
 	if fn, ok := c.templates[template]; !ok {
 		return ""
@@ -104,22 +180,6 @@ func (c *Cli) GetTemplate(template string) string {
 	}
 }
 
-// func (c *Cli) GetHttpClient() *http.Client {
-// 	return c.ua
-// }
-
-// func (c *Cli) SetHttpClient(client *http.Client) {
-// 	c.ua = client
-// }
-
-// func (c *Cli) SetCookieFile(file string) {
-// 	c.cookieFile = file
-// }
-
-// func (c *Cli) RegisterAuthentication(hostname, user, password string) {
-// 	c.authMap[hostname] = fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", user, password))))
-// }
-
 func (c *Cli) CommandLine() *kingpin.Application {
 	log.Errorf("CommandLine not implemented")
 	panic(Exit{1})
@@ -138,24 +198,88 @@ func InitLogging() {
 	logging.SetLevel(logging.NOTICE, "")
 }
 
+// RunCommand runs the Handler or command function registered for command.
+// command can also be an alias or an unambiguous prefix of a command.
+// Unknown commands fall back to a <name>-<command> plugin, see RunPlugin, and
+// otherwise an UnknownCommandError with suggestions is returned.
+// Handlers are cancelled on SIGINT or SIGTERM, in which case an Interrupted
+// error is returned, see ExitCode.  Pre-run and post-run hooks run around
+// the command, see AddPreRunHook.
 func RunCommand(i Interface, command string) error {
+	command, err := resolveCommand(i, command)
+	if err != nil {
+		return err
+	}
+	if fn := getHandler(i, command); fn != nil {
+		// hooks run outside runCancellable so that post-run hooks see the
+		// Interrupted error and are not cancelled with the handler
+		return runHooks(context.Background(), i, command, func() error {
+			return runCancellable(command, func(ctx context.Context) error {
+				return fn(ctx, commandOptions(i, command), getStreams(i))
+			})
+		})
+	}
 	fn := i.GetCommand(command)
 	if fn != nil {
-		return fn()
+		return runHooks(context.Background(), i, command, fn)
+	}
+	if plugin := findPlugin(i, command); plugin != "" {
+		return runHooks(context.Background(), i, command, func() error {
+			return RunPlugin(i, plugin, pluginArgs(command))
+		})
 	}
 	i.CommandLine().Usage([]string{})
 	if command == "" {
 		for _, arg := range os.Args[1:] {
-			if arg[0] != '-' {
+			if arg != "" && arg[0] != '-' {
 				command = arg
 				break
 			}
 		}
 	}
-	return fmt.Errorf("Command %s Unknown", command)
+	names := []string{}
+	for name := range commandNames(i) {
+		names = append(names, name)
+	}
+	return UnknownCommandError{Name: command, Suggestions: suggestCommands(command, names)}
 }
 
+// ProcessAllOptions parses the command line and merges all configs.  Custom
+// commands from the configs are added to the command line, and config
+// aliases, command aliases and unambiguous command prefixes are expanded
+// before it is parsed.  Flags named after the config key of an option, like
+// those of BindFlags, set the option from the command line even when given a
+// zero value.  It panics with Exit when kingpin terminates or a config cannot
+// be loaded, use ProcessAllOptionsE to get those back as errors instead.
 func ProcessAllOptions(i Interface) (string, error) {
+	command, err := ProcessAllOptionsE(i)
+	switch e := err.(type) {
+	case Exit:
+		panic(e)
+	case ConfigParseError, ConfigExecError, ConfigIncludeError, EnvParseError, MissingOptionError:
+		log.Errorf("%s", err)
+		panic(Exit{1})
+	}
+	return command, err
+}
+
+// ProcessAllOptionsE is like ProcessAllOptions but returns an Exit error
+// when kingpin would have terminated (e.g. for --help), an EnvParseError when
+// an option environment variable is invalid, a MissingOptionError when a
+// required option was not set, and a ConfigParseError,
+// ConfigExecError or ConfigIncludeError when a config could not be loaded.
+func ProcessAllOptionsE(i Interface) (command string, err error) {
+	getConfigCache(i).reset()
+	defer func() {
+		if r := recover(); r != nil {
+			exit, ok := r.(Exit)
+			if !ok {
+				panic(r)
+			}
+			err = exit
+		}
+	}()
+
 	app := i.CommandLine()
 	app.Terminate(func(status int) {
 		for _, arg := range os.Args {
@@ -165,7 +289,19 @@ func ProcessAllOptions(i Interface) (string, error) {
 		}
 		panic(Exit{status})
 	})
-	command, err := app.Parse(os.Args[1:])
+	app.PreAction(func(ctx *kingpin.ParseContext) error {
+		recordFlags(i, ctx)
+		return nil
+	})
+	bindCustomCommands(i, app)
+	args := os.Args[1:]
+	if isCompletion(args) {
+		// partial command lines are completed as typed
+		bindAliasCommands(i, app)
+	} else if args, err = expandArgs(i, app, args); err != nil {
+		return "", err
+	}
+	command, err = app.Parse(args)
 	if err != nil {
 		return command, err
 	}
@@ -173,8 +309,7 @@ func ProcessAllOptions(i Interface) (string, error) {
 	os.Setenv(fmt.Sprintf("%s_OPERATION", strings.ToUpper(i.Name())), command)
 
 	// at this point Config is populated with with defaults
-	processConfigs(i)
-	return command, nil
+	return command, processCommandConfigsE(i, command)
 }
 
 // func (c *Cli) ProcessAllOptions() string {
@@ -187,6 +322,20 @@ func ProcessAllOptions(i Interface) (string, error) {
 // }
 
 func processConfigs(i Interface) {
+	if err := processConfigsE(i); err != nil {
+		log.Errorf("%s", err)
+		panic(Exit{1})
+	}
+}
+
+func processConfigsE(i Interface) error {
+	getConfigCache(i).reset()
+	return processCommandConfigsE(i, "")
+}
+
+// processCommandConfigsE merges the global options like processConfigsE, and
+// the options of command and its parent commands.
+func processCommandConfigsE(i Interface, command string) error {
 	defaults := i.GetDefaults()
 	if defaults == nil {
 		defaults = i.NewOptions()
@@ -196,32 +345,48 @@ func processConfigs(i Interface) {
 		options = i.NewOptions()
 	}
 
-	var configFile string
-Outer:
-	for _, name := range []string{"ConfigFile", "config-file"} {
-		for _, collection := range []interface{}{options, defaults} {
-			configFile = getKeyString(collection, name)
-			if configFile != "" {
-				break Outer
-			}
-		}
+	configFile := configFileName(i, options, defaults)
+
+	i.SetOptions(options)
+
+	state := &mergeState{commands: commandLayers(i, command)}
+	cmdline := &merger{source: ConfigSource{Kind: SourceCommandLine}, record: sourceRecorder(i), state: state}
+	cmdline.claim("", reflect.ValueOf(options))
+	for _, cmd := range state.commands {
+		cmdline.claim(commandKey(cmd.Name), reflect.ValueOf(cmd.Options))
 	}
-	if configFile == "" {
-		configFile = fmt.Sprintf(".%s.d/config.yml", i.Name())
+	// flags record their source when given, so they count as set even when
+	// given a zero value like --no-verbose, see recordFlags
+	for key, source := range getSources(i) {
+		if source.Kind == SourceCommandLine {
+			cmdline.set(key)
+		}
 	}
 
-	i.SetOptions(options)
+	if err := loadEnv(i, state); err != nil {
+		return err
+	}
 
-	LoadConfigs(i, configFile)
+	if err := loadConfigs(i, configFile, state); err != nil {
+		return err
+	}
 
 	dv := reflect.ValueOf(defaults)
 	ov := reflect.ValueOf(options)
 
 	log.Debugf("defaults: %#v  options: %#v", defaults, i.GetOptions())
 	log.Debugf("Setting Config from Defaults")
-	MergeStructs(ov, dv)
+	m := &merger{source: ConfigSource{Kind: SourceDefaults}, record: sourceRecorder(i), state: state}
+	m.mergeStructs("", ov, dv)
 	i.SetOptions(ov.Interface())
+	if err := mergeGlobalOptions(i, state); err != nil {
+		return err
+	}
+	if err := validateRequired(i, state); err != nil {
+		return err
+	}
 	populateEnv(i)
+	return nil
 }
 
 // func (c *Cli) SetEditing(dflt bool) {
@@ -248,16 +413,9 @@ func populateEnv(iface Interface) {
 		options = reflect.ValueOf(options.Elem().Interface())
 	}
 	if options.Kind() == reflect.Struct {
+		values := make(map[string]string)
 		for i := 0; i < options.NumField(); i++ {
-			name := strings.Join(camelcase.Split(options.Type().Field(i).Name), "_")
-			envName := fmt.Sprintf("%s_%s", strings.ToUpper(iface.Name()), strings.ToUpper(name))
-
-			envName = strings.Map(func(r rune) rune {
-				if unicode.IsDigit(r) || unicode.IsLetter(r) {
-					return r
-				}
-				return '_'
-			}, envName)
+			envName := envName(iface, options.Type().Field(i))
 			var val string
 			switch t := options.Field(i).Interface().(type) {
 			case string:
@@ -275,66 +433,468 @@ func populateEnv(iface Interface) {
 					val = ""
 				}
 			}
-			os.Setenv(envName, val)
+			values[envName] = val
 		}
+		setOptionEnv(iface, values)
 	}
 }
 
 func LoadConfigs(iface Interface, configFile string) {
+	if err := LoadConfigsE(iface, configFile); err != nil {
+		log.Errorf("%s", err)
+		panic(Exit{1})
+	}
+}
+
+// LoadConfigsE merges every config found for configFile into the options
+// of iface, returning a ConfigParseError, ConfigExecError or
+// ConfigIncludeError on failure.  At each directory level configFile is
+// merged first, then the files in its drop-in directory (config.d for
+// config.yml) in lexical order, each one taking precedence over the last.
+func LoadConfigsE(iface Interface, configFile string) error {
+	getConfigCache(iface).reset()
+	return loadConfigs(iface, configFile, &mergeState{})
+}
+
+// configFileName returns the ConfigFile option from the first of
+// collections that sets it, or the default .<name>.d/config.yml.
+func configFileName(i Interface, collections ...interface{}) string {
+	for _, name := range []string{"ConfigFile", "config-file"} {
+		for _, collection := range collections {
+			if configFile := getKeyString(collection, name); configFile != "" {
+				return configFile
+			}
+		}
+	}
+	return fmt.Sprintf(".%s.d/config.yml", i.Name())
+}
+
+func loadConfigs(iface Interface, configFile string, state *mergeState) error {
 	populateEnv(iface)
 
-	paths := util.FindParentPaths(configFile)
-	// prepend
-	paths = append([]string{fmt.Sprintf("/etc/%s.yml", iface.Name())}, paths...)
+	paths := configPaths(iface, configFile)
+	setConfigPaths(iface, paths)
 
 	// iterate paths in reverse
 	for i := len(paths) - 1; i >= 0; i-- {
-		file := paths[i]
-		if stat, err := os.Stat(file); err == nil {
-			tmp := iface.NewOptions()
-			// check to see if config file is exectuable
-			if stat.Mode()&0111 == 0 {
-				log.Debugf("Loading config %s", file)
-				if fh, err := ioutil.ReadFile(file); err == nil {
-					err := yaml.Unmarshal(fh, tmp)
-					if err != nil {
-						log.Errorf("Unable to parse %s: %s", file, err)
-						panic(Exit{1})
-					}
-					if reflect.ValueOf(tmp).Kind() == reflect.Map {
-						tmp, _ = util.YamlFixup(tmp)
-					}
-				}
-			} else {
-				log.Debugf("Found Executable Config file: %s", file)
-				// it is executable, so run it and try to parse the output
-				cmd := exec.Command(file)
-				stdout := bytes.NewBufferString("")
-				cmd.Stdout = stdout
-				cmd.Stderr = bytes.NewBufferString("")
-				if err := cmd.Run(); err != nil {
-					log.Errorf("%s is exectuable, but it failed to execute: %s\n%s", file, err, cmd.Stderr)
-					panic(Exit{1})
-				}
-				err := yaml.Unmarshal(stdout.Bytes(), tmp)
-				if err != nil {
-					log.Errorf("Failed to parse STDOUT from executable config file %s: %s", file, err)
-					panic(Exit{1})
-				}
+		if stat, err := os.Stat(paths[i]); err == nil && !stat.IsDir() {
+			if err := loadConfig(iface, paths[i], nil, state); err != nil {
+				return err
 			}
+		}
+	}
+	getConfigCache(iface).setConfigs(state.configs)
+	return nil
+}
+
+// configPaths returns every config file candidate for configFile, ordered
+// by precedence lowest first.
+func configPaths(iface Interface, configFile string) []string {
+	paths := configFileNames(fmt.Sprintf("/etc/%s.yml", iface.Name()))
+	parents := make([][]string, 0)
+	for _, name := range configFileNames(configFile) {
+		parents = append(parents, util.ParentPaths(name))
+	}
+	// interleave so that every format is checked at each directory level,
+	// followed by the files in the drop-in directory for that level
+	for level := 0; len(parents) > 0 && level < len(parents[0]); level++ {
+		for _, candidates := range parents {
+			paths = append(paths, candidates[level])
+		}
+		paths = append(paths, configDropIns(configDropInDir(parents[len(parents)-1][level]))...)
+	}
+	return paths
+}
+
+// configDropInDir returns the drop-in directory for configFile, which is
+// named after configFile without its extension, e.g. config.yml has drop-ins
+// in config.d.
+func configDropInDir(configFile string) string {
+	return strings.TrimSuffix(configFile, filepath.Ext(configFile)) + ".d"
+}
+
+// configDropIns returns the config files in dir with a registered format
+// extension in lexical order.
+func configDropIns(dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	dropIns := []string{}
+	for _, file := range files {
+		if file.IsDir() || GetConfigFormat(configExt(file.Name())) == nil {
+			continue
+		}
+		dropIns = append(dropIns, filepath.Join(dir, file.Name()))
+	}
+	return dropIns
+}
+
+// loadConfig merges a single config file into the options of iface, then
+// merges the files it includes.  The including file takes precedence over
+// its includes, and later includes take precedence over earlier ones.
+// including is the chain of files that included this one.
+func loadConfig(iface Interface, file string, including []string, state *mergeState) error {
+	config, err := getConfigCache(iface).read(file)
+	if config == nil {
+		return err
+	}
+	source, ext, content := config.source, config.ext, config.content
+
+	data := map[string]interface{}{}
+	if err := decodeConfig(ext, content, &data); err != nil {
+		return newConfigParseError(file, source.Kind == SourceExec, err)
+	}
+	data = normalizeConfig(data).(map[string]interface{})
+
+	includes, err := configIncludes(file, data)
+	if err != nil {
+		return err
+	}
 
-			nv := reflect.ValueOf(tmp)
-			ov := reflect.ValueOf(iface.GetOptions())
+	// key! directives are stripped and the cleaned up config is decoded
+	// instead of the original content
+	finals := extractDirectives("", data)
+	if len(finals) > 0 {
+		if content, err = yaml.Marshal(data); err != nil {
+			return err
+		}
+		ext = "yml"
+	}
+	state.configs = append(state.configs, newRawConfig(file, data, finals))
+	if state.scan {
+		return loadConfigIncludes(iface, file, includes, including, state)
+	}
 
-			log.Debugf("Setting Config from %s", file)
-			MergeStructs(ov, nv)
-			iface.SetOptions(ov.Interface())
-			populateEnv(iface)
+	tmp := iface.NewOptions()
+	if err := decodeConfig(ext, content, tmp); err != nil {
+		return newConfigParseError(file, source.Kind == SourceExec, err)
+	}
+	if source.Kind == SourceFile && reflect.ValueOf(tmp).Kind() == reflect.Map {
+		tmp, _ = util.YamlFixup(tmp)
+	}
+	if data, ok := tmp.(map[string]interface{}); ok {
+		stripConfigOnlyKeys(iface, data)
+	}
+
+	nv := reflect.ValueOf(tmp)
+	ov := reflect.ValueOf(iface.GetOptions())
+
+	log.Debugf("Setting Config from %s", file)
+	m := &merger{source: source, record: sourceRecorder(iface), state: state, present: presentKeys("", data)}
+	m.mergeStructs("", ov, nv)
+	if err := mergeCommandSections(data, source, sourceRecorder(iface), state); err != nil {
+		return newConfigParseError(file, source.Kind == SourceExec, err)
+	}
+	m.finalize(finals...)
+	iface.SetOptions(ov.Interface())
+	populateEnv(iface)
+
+	return loadConfigIncludes(iface, file, includes, including, state)
+}
+
+// loadConfigIncludes loads the includes of file, the last one first.
+func loadConfigIncludes(iface Interface, file string, includes, including []string, state *mergeState) error {
+	including = append(including, file)
+	for i := len(includes) - 1; i >= 0; i-- {
+		for _, parent := range including {
+			if sameFile(parent, includes[i]) {
+				return ConfigIncludeError{File: file, Include: includes[i], Err: fmt.Errorf("include cycle detected")}
+			}
+		}
+		if err := loadConfig(iface, includes[i], including, state); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// configOnlyKeys are the top level config keys read by cliby itself rather
+// than merged into the options.
+var configOnlyKeys = []string{"include", "aliases", "custom-commands", "hooks", "auth", "retry", "credential-store"}
+
+// stripConfigOnlyKeys removes the configOnlyKeys from the map options of a
+// config, and the commands section when it is merged into registered
+// commands, so they do not show up in the merged options.
+func stripConfigOnlyKeys(iface Interface, data map[string]interface{}) {
+	for _, key := range configOnlyKeys {
+		delete(data, key)
+	}
+	if len(getRegisteredCommands(iface)) > 0 {
+		delete(data, "commands")
+	}
+}
+
+// configIncludes returns the files named by the top level include directive
+// of a config, resolved relative to the directory of the including file with
+// globs expanded.
+func configIncludes(file string, data map[string]interface{}) ([]string, error) {
+	var patterns []string
+	switch include := data["include"].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		patterns = []string{include}
+	case []interface{}:
+		for _, pattern := range include {
+			patterns = append(patterns, fmt.Sprint(pattern))
+		}
+	default:
+		return nil, ConfigIncludeError{File: file, Err: fmt.Errorf("include must be a string or a list of strings")}
+	}
+
+	includes := []string{}
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(file), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, ConfigIncludeError{File: file, Include: pattern, Err: err}
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, ConfigIncludeError{File: file, Include: pattern, Err: fmt.Errorf("file not found")}
+		}
+		includes = append(includes, matches...)
+	}
+	return includes, nil
+}
+
+// presentKeys returns the key paths of every map key in data.
+func presentKeys(key string, data map[string]interface{}) map[string]bool {
+	present := make(map[string]bool)
+	for k, v := range data {
+		present[joinKey(key, k)] = true
+		if sub, ok := v.(map[string]interface{}); ok {
+			for subKey := range presentKeys(joinKey(key, k), sub) {
+				present[subKey] = true
+			}
+		}
+	}
+	return present
+}
+
+// normalizeConfig converts the nested maps of a decoded config to
+// map[string]interface{} so they can be walked like the top level map.
+func normalizeConfig(data interface{}) interface{} {
+	switch d := data.(type) {
+	case map[interface{}]interface{}:
+		normal := make(map[string]interface{})
+		for k, v := range d {
+			normal[fmt.Sprint(k)] = normalizeConfig(v)
+		}
+		return normal
+	case map[string]interface{}:
+		normal := make(map[string]interface{})
+		for k, v := range d {
+			normal[k] = normalizeConfig(v)
+		}
+		return normal
+	case []interface{}:
+		normal := make([]interface{}, 0, len(d))
+		for _, v := range d {
+			normal = append(normal, normalizeConfig(v))
+		}
+		return normal
+	default:
+		return d
+	}
+}
+
+// extractDirectives strips the "!" suffix from "key!" directives in data,
+// removing keys whose value is null, and returns the key paths that should
+// be final once data has been merged.
+func extractDirectives(key string, data map[string]interface{}) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	finals := []string{}
+	for _, k := range keys {
+		v := data[k]
+		name := k
+		if strings.HasSuffix(k, "!") {
+			name = strings.TrimSuffix(k, "!")
+			delete(data, k)
+			if v == nil {
+				delete(data, name)
+			} else {
+				data[name] = v
+			}
+			finals = append(finals, joinKey(key, name))
+		}
+		if sub, ok := v.(map[string]interface{}); ok {
+			finals = append(finals, extractDirectives(joinKey(key, name), sub)...)
+		}
+	}
+	return finals
+}
+
+func sameFile(a, b string) bool {
+	if sa, err := os.Stat(a); err == nil {
+		if sb, err := os.Stat(b); err == nil {
+			return os.SameFile(sa, sb)
+		}
+	}
+	return false
 }
 
 func MergeStructs(ov, nv reflect.Value) {
+	(&merger{}).mergeStructs("", ov, nv)
+}
+
+func MergeMaps(ov, nv reflect.Value) {
+	(&merger{}).mergeMaps("", ov, nv)
+}
+
+func MergeArrays(ov, nv reflect.Value) reflect.Value {
+	return (&merger{}).mergeArrays("", ov, nv)
+}
+
+// merger implements MergeStructs, MergeMaps and MergeArrays while recording
+// the key path of every value it sets along with the source it came from.
+type merger struct {
+	source ConfigSource
+	record func(key string, source ConfigSource)
+	state  *mergeState
+	// present holds the key paths that appear in the source, so that zero
+	// values can be set explicitly.  When nil any non-zero value counts as
+	// present.
+	present map[string]bool
+}
+
+// mergeState is shared by the mergers for every source merged into the
+// same options, from highest to lowest precedence.
+type mergeState struct {
+	// final holds key paths that a "key!" directive marked as final, lower
+	// precedence sources can no longer change them.
+	final map[string]bool
+	// set holds key paths explicitly set by a source, even to a zero value,
+	// so lower precedence sources do not override them.
+	set map[string]bool
+	// fixed holds key paths set by the command line or the environment,
+	// which merge=last does not let configs and defaults override.
+	fixed map[string]bool
+	// commands holds the command layers whose options are merged along
+	// with the global options.
+	commands []*Command
+	// configs holds the config-only keys of the configs loaded so far,
+	// closest first.
+	configs []rawConfig
+	// scan only collects configs, without merging them into the options.
+	scan bool
+}
+
+func (m *merger) isSet(key string) bool {
+	return m.state != nil && m.state.set[key]
+}
+
+func (m *merger) isFixed(key string) bool {
+	return m.state != nil && m.state.fixed[key]
+}
+
+func (m *merger) isPresent(key string, nv reflect.Value) bool {
+	if m.present != nil {
+		return m.present[key]
+	}
+	return !isZero(nv)
+}
+
+func (m *merger) finalize(keys ...string) {
+	if m.state == nil {
+		m.state = &mergeState{}
+	}
+	if m.state.final == nil {
+		m.state.final = make(map[string]bool)
+	}
+	for _, key := range keys {
+		log.Debugf("%s is final", key)
+		m.state.final[key] = true
+	}
+}
+
+func (m *merger) isFinal(key string) bool {
+	if m.state == nil {
+		return false
+	}
+	for ; key != ""; key = parentKey(key) {
+		if m.state.final[key] {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *merger) hasFinalChild(key string) bool {
+	if m.state == nil {
+		return false
+	}
+	for final := range m.state.final {
+		if strings.HasPrefix(final, key+".") || strings.HasPrefix(final, key+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+// fresh returns nv to be set at key, or a copy of it without the keys that
+// were finalized under key by a higher precedence source.
+func (m *merger) fresh(key string, nv reflect.Value) reflect.Value {
+	if nv.Kind() != reflect.Map || !m.hasFinalChild(key) {
+		return nv
+	}
+	ov := reflect.MakeMap(nv.Type())
+	m.mergeMaps(key, ov, nv)
+	return ov
+}
+
+func (m *merger) set(key string) {
+	if key == "" {
+		return
+	}
+	if m.state != nil {
+		if m.state.set == nil {
+			m.state.set = make(map[string]bool)
+		}
+		m.state.set[key] = true
+		if m.source.Kind == SourceCommandLine || m.source.Kind == SourceEnv {
+			if m.state.fixed == nil {
+				m.state.fixed = make(map[string]bool)
+			}
+			m.state.fixed[key] = true
+		}
+	}
+	if m.record != nil {
+		m.record(key, m.source)
+	}
+}
+
+// claim records every non-zero top level value in v as coming from the
+// merger source, used for values that were populated before merging
+// started, like command line flags.
+func (m *merger) claim(key string, v reflect.Value) {
+	v = reflect.Indirect(v)
+	if v.Kind() == reflect.Interface {
+		v = reflect.Indirect(v.Elem())
+	}
+	switch v.Kind() {
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			m.set(joinKey(key, fmt.Sprint(k.Interface())))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			if !reflect.DeepEqual(v.Field(i).Interface(), reflect.Zero(v.Field(i).Type()).Interface()) {
+				m.set(joinKey(key, fieldKey(v.Type().Field(i))))
+			}
+		}
+	}
+}
+
+func (m *merger) mergeStructs(key string, ov, nv reflect.Value) {
 	if ov.Kind() == reflect.Ptr {
 		ov = ov.Elem()
 	}
@@ -342,22 +902,44 @@ func MergeStructs(ov, nv reflect.Value) {
 		nv = nv.Elem()
 	}
 	if ov.Kind() == reflect.Map && nv.Kind() == reflect.Map {
-		MergeMaps(ov, nv)
+		m.mergeMaps(key, ov, nv)
 		return
 	}
 	if !ov.IsValid() || !nv.IsValid() {
 		return
 	}
 	for i := 0; i < nv.NumField(); i++ {
+		fkey := joinKey(key, fieldKey(nv.Type().Field(i)))
+		if m.isFinal(fkey) {
+			continue
+		}
+		if m.mergeStrategy(fkey, parseClibyTag(nv.Type().Field(i)).Get("merge"), ov.Field(i), nv.Field(i)) {
+			continue
+		}
+		switch ov.Field(i).Kind() {
+		case reflect.Map, reflect.Slice, reflect.Array:
+		default:
+			// scalars track whether they were set so a higher precedence
+			// source can set them to their zero value
+			if m.state != nil {
+				if !m.isSet(fkey) && m.isPresent(fkey, nv.Field(i)) {
+					log.Debugf("Setting %s to %#v", nv.Type().Field(i).Name, nv.Field(i).Interface())
+					ov.Field(i).Set(nv.Field(i))
+					m.set(fkey)
+				}
+				continue
+			}
+		}
 		if reflect.DeepEqual(ov.Field(i).Interface(), reflect.Zero(ov.Field(i).Type()).Interface()) && !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
 			log.Debugf("Setting %s to %#v", nv.Type().Field(i).Name, nv.Field(i).Interface())
-			ov.Field(i).Set(nv.Field(i))
+			ov.Field(i).Set(m.fresh(fkey, nv.Field(i)))
+			m.set(fkey)
 		} else {
 			switch ov.Field(i).Kind() {
 			case reflect.Map:
 				if nv.Field(i).Len() > 0 {
 					log.Debugf("merging: %v with %v", ov.Field(i), nv.Field(i))
-					MergeMaps(ov.Field(i), nv.Field(i))
+					m.mergeMaps(fkey, ov.Field(i), nv.Field(i))
 				}
 			case reflect.Slice:
 				if nv.Field(i).Len() > 0 {
@@ -365,9 +947,10 @@ func MergeStructs(ov, nv reflect.Value) {
 					if ov.Field(i).CanSet() {
 						if ov.Field(i).Len() == 0 {
 							ov.Field(i).Set(nv.Field(i))
+							m.set(fkey)
 						} else {
 							log.Debugf("merging: %v with %v", ov.Field(i), nv.Field(i))
-							ov.Field(i).Set(MergeArrays(ov.Field(i), nv.Field(i)))
+							ov.Field(i).Set(m.mergeArrays(fkey, ov.Field(i), nv.Field(i)))
 						}
 					}
 
@@ -375,37 +958,118 @@ func MergeStructs(ov, nv reflect.Value) {
 			case reflect.Array:
 				if nv.Field(i).Len() > 0 {
 					log.Debugf("merging: %v with %v", ov.Field(i), nv.Field(i))
-					ov.Field(i).Set(MergeArrays(ov.Field(i), nv.Field(i)))
+					ov.Field(i).Set(m.mergeArrays(fkey, ov.Field(i), nv.Field(i)))
 				}
 			}
 		}
 	}
 }
 
-func MergeMaps(ov, nv reflect.Value) {
-	for _, key := range nv.MapKeys() {
-		if !ov.MapIndex(key).IsValid() {
-			log.Debugf("Setting %v to %#v", key.Interface(), nv.MapIndex(key).Interface())
-			ov.SetMapIndex(key, nv.MapIndex(key))
-		} else {
-			ovi := reflect.ValueOf(ov.MapIndex(key).Interface())
-			nvi := reflect.ValueOf(nv.MapIndex(key).Interface())
-			switch ovi.Kind() {
-			case reflect.Map:
-				log.Debugf("merging: %v with %v", ovi.Interface(), nvi.Interface())
-				MergeMaps(ovi, nvi)
-			case reflect.Slice:
-				log.Debugf("merging: %v with %v", ovi.Interface(), nvi.Interface())
-				ov.SetMapIndex(key, MergeArrays(ovi, nvi))
-			case reflect.Array:
-				log.Debugf("merging: %v with %v", ovi.Interface(), nvi.Interface())
-				ov.SetMapIndex(key, MergeArrays(ovi, nvi))
-			}
+// mergeStrategy merges a struct field according to the strategy from its
+// `cliby:"merge=..."` tag, returning false if the field has no strategy and
+// the default merge applies.
+func (m *merger) mergeStrategy(key, strategy string, ov, nv reflect.Value) bool {
+	switch strategy {
+	case MergeFirst, MergeReplace:
+		if m.isSet(key) {
+			break
 		}
+		if isZero(ov) && m.isPresent(key, nv) {
+			ov.Set(nv)
+			m.set(key)
+		}
+	case MergeLast:
+		if m.isFixed(key) {
+			break
+		}
+		if m.isPresent(key, nv) {
+			ov.Set(nv)
+			m.set(key)
+		}
+	case MergeAppend:
+		if ov.Kind() != reflect.Slice {
+			log.Warningf("merge=%s is only valid for slices, ignoring for %s", strategy, key)
+			return false
+		}
+		if ov.Len() == 0 && nv.Len() > 0 {
+			ov.Set(nv)
+			m.set(key)
+			return true
+		}
+		for i := 0; i < nv.Len(); i++ {
+			ov.Set(reflect.Append(ov, nv.Index(i)))
+			m.set(indexKey(key, ov.Len()-1))
+		}
+	case MergeUnion, "":
+		return false
+	default:
+		log.Warningf("Unknown merge strategy %q for %s", strategy, key)
+		return false
 	}
+	return true
 }
 
-func MergeArrays(ov, nv reflect.Value) reflect.Value {
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// mergeMaps merges nv into ov.  Keys in nv with a "!" suffix are merged
+// before all others and then marked final, a null value for such a key
+// unsets it for lower precedence sources instead.
+func (m *merger) mergeMaps(key string, ov, nv reflect.Value) {
+	finals := []string{}
+	for _, k := range nv.MapKeys() {
+		name := fmt.Sprint(k.Interface())
+		if !strings.HasSuffix(name, "!") {
+			continue
+		}
+		name = strings.TrimSuffix(name, "!")
+		mapKey := joinKey(key, name)
+		if val := nv.MapIndex(k); !m.isFinal(mapKey) && val.IsValid() && !(val.Kind() == reflect.Interface && val.IsNil()) {
+			m.mergeMapKey(mapKey, ov, reflect.ValueOf(name).Convert(ov.Type().Key()), val)
+		}
+		finals = append(finals, mapKey)
+	}
+	m.finalize(finals...)
+
+	for _, k := range nv.MapKeys() {
+		if strings.HasSuffix(fmt.Sprint(k.Interface()), "!") {
+			continue
+		}
+		mapKey := joinKey(key, fmt.Sprint(k.Interface()))
+		if m.isFinal(mapKey) {
+			continue
+		}
+		m.mergeMapKey(mapKey, ov, k, nv.MapIndex(k))
+	}
+}
+
+func (m *merger) mergeMapKey(mapKey string, ov, k, nvk reflect.Value) {
+	if !ov.MapIndex(k).IsValid() {
+		log.Debugf("Setting %v to %#v", k.Interface(), nvk.Interface())
+		ov.SetMapIndex(k, m.fresh(mapKey, reflect.ValueOf(nvk.Interface())))
+		m.set(mapKey)
+	} else {
+		ovi := reflect.ValueOf(ov.MapIndex(k).Interface())
+		nvi := reflect.ValueOf(nvk.Interface())
+		switch ovi.Kind() {
+		case reflect.Map:
+			log.Debugf("merging: %v with %v", ovi.Interface(), nvi.Interface())
+			m.mergeMaps(mapKey, ovi, nvi)
+		case reflect.Slice:
+			log.Debugf("merging: %v with %v", ovi.Interface(), nvi.Interface())
+			ov.SetMapIndex(k, m.mergeArrays(mapKey, ovi, nvi))
+		case reflect.Array:
+			log.Debugf("merging: %v with %v", ovi.Interface(), nvi.Interface())
+			ov.SetMapIndex(k, m.mergeArrays(mapKey, ovi, nvi))
+		}
+	}
+}
+
+func (m *merger) mergeArrays(key string, ov, nv reflect.Value) reflect.Value {
+	if m.isFinal(key) {
+		return ov
+	}
 Outer:
 	for ni := 0; ni < nv.Len(); ni++ {
 		niv := nv.Index(ni)
@@ -417,227 +1081,11 @@ Outer:
 		}
 		log.Debugf("appending %v to %v", niv.Interface(), ov)
 		ov = reflect.Append(ov, niv)
+		m.set(indexKey(key, ov.Len()-1))
 	}
 	return ov
 }
 
-// func (c *Cli) saveCookies(resp *http.Response) {
-// 	if _, ok := resp.Header["Set-Cookie"]; !ok {
-// 		return
-// 	}
-
-// 	cookies := resp.Cookies()
-// 	for _, cookie := range cookies {
-// 		if cookie.Domain == "" {
-// 			// if it is host:port then we need to split off port
-// 			parts := strings.Split(resp.Request.URL.Host, ":")
-// 			host := parts[0]
-// 			log.Debug("Setting DOMAIN to %s for Cookie: %s", host, cookie)
-// 			cookie.Domain = host
-// 		}
-// 	}
-
-// 	// expiry in one week from now
-// 	expiry := time.Now().Add(24 * 7 * time.Hour)
-// 	for _, cookie := range cookies {
-// 		cookie.Expires = expiry
-// 	}
-
-// 	if currentCookies := c.loadCookies(); currentCookies != nil {
-// 		currentCookiesByName := make(map[string]*http.Cookie)
-// 		for _, cookie := range currentCookies {
-// 			currentCookiesByName[cookie.Name+cookie.Domain] = cookie
-// 		}
-
-// 		for _, cookie := range cookies {
-// 			currentCookiesByName[cookie.Name+cookie.Domain] = cookie
-// 		}
-
-// 		mergedCookies := make([]*http.Cookie, 0, len(currentCookiesByName))
-// 		for _, v := range currentCookiesByName {
-// 			mergedCookies = append(mergedCookies, v)
-// 		}
-// 		util.JsonWrite(c.cookieFile, mergedCookies)
-// 	} else {
-// 		util.JsonWrite(c.cookieFile, cookies)
-// 	}
-// }
-
-// func (c *Cli) loadCookies() []*http.Cookie {
-// 	bytes, err := ioutil.ReadFile(c.cookieFile)
-// 	if err != nil && os.IsNotExist(err) {
-// 		// dont load cookies if the file does not exist
-// 		return nil
-// 	}
-// 	if err != nil {
-// 		log.Errorf("Failed to open %s: %s", c.cookieFile, err)
-// 		panic(Exit{1})
-// 	}
-// 	cookies := make([]*http.Cookie, 0)
-// 	err = json.Unmarshal(bytes, &cookies)
-// 	if err != nil {
-// 		log.Errorf("Failed to parse json from file %s: %s", c.cookieFile, err)
-// 	}
-
-// 	if os.Getenv("LOG_TRACE") != "" && log.IsEnabledFor(logging.DEBUG) {
-// 		log.Debugf("Loading Cookies: %s", cookies)
-// 	}
-// 	return cookies
-// }
-
-// func (c *Cli) initCookies(uri string) {
-// 	url, _ := url.Parse(uri)
-// 	if c.ua.Jar == nil {
-// 		jar, _ := cookiejar.New(nil)
-// 		c.ua.Jar = jar
-// 	}
-// 	c.ua.Jar.SetCookies(url, c.loadCookies())
-// 	for _, cookie := range c.ua.Jar.Cookies(url) {
-// 		log.Debugf("Using Cookie: %s", cookie)
-// 	}
-// }
-
-// func (c *Cli) PostTimeout(msTimeout int, uri, content string) (*http.Response, error) {
-// 	oldUA := c.setTimeoutHandler(msTimeout)
-// 	defer c.SetHttpClient(oldUA)
-// 	return c.Post(uri, content)
-// }
-
-// func (c *Cli) Post(uri string, content string) (*http.Response, error) {
-// 	c.initCookies(uri)
-// 	return c.makeRequestWithContent("POST", uri, content, "application/json")
-// }
-
-// func (c *Cli) Put(uri string, content string) (*http.Response, error) {
-// 	c.initCookies(uri)
-// 	return c.makeRequestWithContent("PUT", uri, content, "application/json")
-// }
-
-// func (c *Cli) Delete(uri string, content string) (*http.Response, error) {
-// 	c.initCookies(uri)
-// 	return c.makeRequestWithContent("DELETE", uri, content, "application/json")
-// }
-
-// func (c *Cli) PostXML(uri string, content string) (*http.Response, error) {
-// 	c.initCookies(uri)
-// 	return c.makeRequestWithContent("POST", uri, content, "application/xml")
-// }
-
-// func (c *Cli) PutXML(uri string, content string) (*http.Response, error) {
-// 	c.initCookies(uri)
-// 	return c.makeRequestWithContent("PUT", uri, content, "application/xml")
-// }
-
-// func (c *Cli) PostForm(uri string, content string) (*http.Response, error) {
-// 	c.initCookies(uri)
-// 	return c.makeRequestWithContent("POST", uri, content, "application/x-www-form-urlencoded")
-// }
-
-// func (c *Cli) makeRequestWithContent(method string, uri string, content string, contentType string) (*http.Response, error) {
-// 	buffer := bytes.NewBufferString(content)
-// 	req, _ := http.NewRequest(method, uri, buffer)
-// 	req.Header.Set("Content-Type", contentType)
-
-// 	log.Debugf("%s %s", req.Method, req.URL.String())
-// 	return c.makeRequest(req)
-// }
-
-// func (c *Cli) setTimeoutHandler(msTimeout int) *http.Client {
-// 	oldUA := c.GetHttpClient()
-// 	var transport http.RoundTripper = &http.Transport{
-// 		Proxy: http.ProxyFromEnvironment,
-// 		Dial: (&net.Dialer{
-// 			Timeout:   time.Duration(msTimeout) * time.Millisecond,
-// 			KeepAlive: 30 * time.Second,
-// 		}).Dial,
-// 		TLSHandshakeTimeout: 10 * time.Second,
-// 	}
-
-// 	c.SetHttpClient(&http.Client{
-// 		Transport: transport,
-// 	})
-// 	return oldUA
-// }
-
-// func (c *Cli) GetTimeout(msTimeout int, uri string) (*http.Response, error) {
-// 	oldUA := c.setTimeoutHandler(msTimeout)
-// 	defer c.SetHttpClient(oldUA)
-// 	return c.Get(uri)
-// }
-
-// func (c *Cli) Get(uri string) (*http.Response, error) {
-// 	c.initCookies(uri)
-// 	req, err := http.NewRequest("GET", uri, nil)
-// 	if err != nil {
-// 		log.Errorf("Invalid Request: %s", uri)
-// 		return nil, err
-// 	}
-// 	req.Header.Set("Content-Type", "application/json")
-// 	log.Debugf("%s %s", req.Method, req.URL.String())
-// 	if log.IsEnabledFor(logging.DEBUG) {
-// 		logBuffer := bytes.NewBuffer(make([]byte, 0))
-// 		req.Write(logBuffer)
-// 		log.Debugf("%s", logBuffer)
-// 	}
-
-// 	return c.makeRequest(req)
-// }
-
-// func (c *Cli) Head(uri string) (*http.Response, error) {
-// 	c.initCookies(uri)
-// 	req, err := http.NewRequest("HEAD", uri, nil)
-// 	if err != nil {
-// 		log.Errorf("Invalid Request: %s", uri)
-// 		return nil, err
-// 	}
-// 	req.Header.Set("Content-Type", "application/json")
-// 	log.Debugf("%s %s", req.Method, req.URL.String())
-// 	if log.IsEnabledFor(logging.DEBUG) {
-// 		logBuffer := bytes.NewBuffer(make([]byte, 0))
-// 		req.Write(logBuffer)
-// 		log.Debugf("%s", logBuffer)
-// 	}
-
-// 	return c.makeRequest(req)
-// }
-
-// func (c *Cli) makeRequest(req *http.Request) (resp *http.Response, err error) {
-// 	if auth, ok := c.authMap[req.URL.Host]; ok {
-// 		req.Header.Add("Authorization", auth)
-// 	}
-
-// 	if resp, err = c.ua.Do(req); resp != nil {
-// 		if os.Getenv("LOG_TRACE") != "" && log.IsEnabledFor(logging.DEBUG) {
-// 			out, err := httputil.DumpRequest(req, true)
-// 			if err != nil {
-// 				log.Debugf("Failed to Dump Request: %s", err)
-// 			} else {
-// 				log.Debugf("Request: %s", out)
-// 			}
-// 			out, err = httputil.DumpResponse(resp, true)
-// 			if err != nil {
-// 				log.Debugf("Failed to Dump Response: %s", err)
-// 			} else {
-// 				log.Debugf("Response: %s", out)
-// 			}
-// 		}
-
-// 		if (resp.StatusCode < 200 || resp.StatusCode >= 300) && resp.StatusCode != 401 {
-// 			log.Debugf("response status: %s", resp.Status)
-// 		}
-
-// 		c.saveCookies(resp)
-// 		return resp, err
-// 	} else {
-// 		if os.Getenv("LOG_TRACE") != "" && log.IsEnabledFor(logging.DEBUG) {
-// 			out, _ := httputil.DumpRequestOut(req, true)
-// 			log.Debugf("Request: %s", out)
-// 		}
-// 		return nil, err
-// 	}
-// 	return resp, nil
-// }
-
 // func (c *Cli) GetTemplate(name string) string {
 // 	if override, ok := c.Opts["template"].(string); ok {
 // 		if _, err := os.Stat(override); err == nil {
@@ -1,10 +1,21 @@
 package cliby
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/pmezard/go-difflib/difflib"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -43,6 +54,8 @@ var TestOptionMergeExpected = map[string]interface{}{
 	},
 }
 
+var testRoot, _ = os.Getwd()
+
 type TestCli struct {
 	Cli
 }
@@ -199,6 +212,1600 @@ func TestOptionMergeSubdir(t *testing.T) {
 	}
 }
 
+var TestOptionMergeDirectivesExpected = map[string]interface{}{
+	"a": 1,
+	"b": 7,
+	"A": 1,
+	"C": 1,
+	"hash": map[string]interface{}{
+		"a": 1,
+		"b": 101,
+		"A": 1,
+		"C": 1,
+		"hol": map[string]interface{}{
+			"a": []interface{}{5},
+			"b": []interface{}{101, 102, 998, 999, 3, 4},
+		},
+	},
+	"list": []interface{}{
+		"x",
+	},
+}
+
+func TestOptionMergeDirectives(t *testing.T) {
+	os.Chdir(filepath.Join(testRoot, "subdir/directives"))
+	cli := &TestCli{*New("test")}
+	cli.SetDefaults(map[string]interface{}{
+		"a": 1,
+		"b": 2,
+		"hash": map[string]interface{}{
+			"a": 1,
+			"b": 2,
+			"hoh": map[string]interface{}{
+				"a": 1,
+				"b": 2,
+			},
+			"hol": map[string]interface{}{
+				"a": []interface{}{1, 2},
+				"b": []interface{}{3, 4},
+			},
+		},
+		"list": []interface{}{
+			"a",
+			"b",
+		},
+		"lol": []interface{}{
+			[]interface{}{"a", "b", "c"},
+			[]interface{}{"d", "e", "f"},
+		},
+	})
+
+	ProcessAllOptions(cli)
+	if !reflect.DeepEqual(cli.GetOptions(), TestOptionMergeDirectivesExpected) {
+		got, _ := json.MarshalIndent(cli.GetOptions(), "", "    ")
+		expected, _ := json.MarshalIndent(TestOptionMergeDirectivesExpected, "", "    ")
+
+		diff := difflib.UnifiedDiff{
+			A:        difflib.SplitLines(string(expected)),
+			B:        difflib.SplitLines(string(got)),
+			FromFile: "Expected",
+			ToFile:   "Got",
+			Context:  3,
+		}
+		result, _ := difflib.GetUnifiedDiffString(diff)
+		log.Errorf("Diff:\n%s", result)
+		t.Fail()
+	}
+}
+
+func TestMergeMapsDirectives(t *testing.T) {
+	ov := map[string]interface{}{
+		"list": []interface{}{"a"},
+	}
+	nv := map[string]interface{}{
+		"list!": []interface{}{"b"},
+		"list":  []interface{}{"c"},
+		"gone!": nil,
+		"gone":  1,
+		"kept":  2,
+	}
+	MergeMaps(reflect.ValueOf(ov), reflect.ValueOf(nv))
+	expected := map[string]interface{}{
+		"list": []interface{}{"a", "b"},
+		"kept": 2,
+	}
+	if !reflect.DeepEqual(ov, expected) {
+		t.Errorf("Expected %#v but got %#v", expected, ov)
+	}
+}
+
+func TestOptionSources(t *testing.T) {
+	os.Chdir(filepath.Join(testRoot, "subdir"))
+	defer os.Chdir(testRoot)
+	cli := &TestCli{*New("test")}
+	cli.SetDefaults(map[string]interface{}{
+		"a": 1,
+		"b": 2,
+		"list": []interface{}{
+			"a",
+			"b",
+		},
+	})
+	os.Args = []string{os.Args[0]}
+	ProcessAllOptions(cli)
+
+	rootConfig := ConfigSource{Kind: SourceFile, File: filepath.Join(testRoot, ".test.d/config.yml")}
+	subdirConfig := ConfigSource{Kind: SourceFile, File: filepath.Join(testRoot, "subdir/.test.d/config.yml")}
+	defaults := ConfigSource{Kind: SourceDefaults}
+
+	for key, expected := range map[string]ConfigSource{
+		"a":           defaults,
+		"b":           subdirConfig,
+		"A":           rootConfig,
+		"hash.hoh.C":  subdirConfig,
+		"hash.hol.a":  subdirConfig,
+		"list":        subdirConfig,
+		"list[2]":     rootConfig,
+		"list[4]":     defaults,
+		"lol[1]":      subdirConfig,
+		"lol[2][1]":   rootConfig,
+		"hash.hoh.zz": subdirConfig,
+	} {
+		if got, ok := cli.GetSource(key); !ok || got != expected {
+			t.Errorf("Expected source of %s to be %s but got %s", key, expected, got)
+		}
+	}
+	if _, ok := cli.GetSource("missing"); ok {
+		t.Errorf("Expected no source for missing key")
+	}
+}
+
+func TestExplainConfig(t *testing.T) {
+	os.Chdir(filepath.Join(testRoot, "subdir"))
+	defer os.Chdir(testRoot)
+	cli := &TestCli{*New("test")}
+	cli.SetDefaults(map[string]interface{}{"a": 1})
+	os.Args = []string{os.Args[0]}
+	ProcessAllOptions(cli)
+
+	var buf bytes.Buffer
+	if err := ExplainConfig(cli, "json", &buf); err != nil {
+		t.Fatal(err)
+	}
+	var got configExplanation
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	searched := map[string]bool{}
+	for _, path := range got.Searched {
+		searched[path.Path] = path.Exists
+	}
+	if exists, ok := searched["/etc/test.yml"]; !ok || exists {
+		t.Errorf("Expected /etc/test.yml as a missing candidate, got %#v", got.Searched)
+	}
+	if exists := searched[filepath.Join(testRoot, "subdir/.test.d/config.yml")]; !exists {
+		t.Errorf("Expected subdir config as an existing candidate, got %#v", got.Searched)
+	}
+	expected := map[string]string{
+		"a":          "defaults",
+		"b":          "file " + filepath.Join(testRoot, "subdir/.test.d/config.yml"),
+		"hash.hoh.A": "file " + filepath.Join(testRoot, ".test.d/config.yml"),
+	}
+	for _, value := range got.Options {
+		if source, ok := expected[value.Key]; ok {
+			if value.Source != source {
+				t.Errorf("Expected source of %s to be %q but got %q", value.Key, source, value.Source)
+			}
+			delete(expected, value.Key)
+		}
+	}
+	if len(expected) > 0 {
+		t.Errorf("Missing explained options: %v", expected)
+	}
+}
+
+type TestConfigCommandCli struct {
+	TestScalarCli
+}
+
+func (c *TestConfigCommandCli) CommandLine() *kingpin.Application {
+	app := kingpin.New("show", "")
+	AddConfigCommand(c, app)
+	return app
+}
+
+func TestConfigCommand(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.MkdirAll(".show.d/config.d", 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".show.d/config.yml"), []byte("name: root\ncount: 1\n"), 0644)
+	dropIn := filepath.Join(dir, ".show.d/config.d/10-count.yml")
+	ioutil.WriteFile(dropIn, []byte("count: 3\n"), 0644)
+	defer func(args []string) { os.Args = args }(os.Args)
+
+	// the cli has its own name so that the variables it exports do not leak
+	// into the other tests
+	cli := &TestConfigCommandCli{TestScalarCli{*New("show")}}
+	out := &bytes.Buffer{}
+	cli.SetStreams(IOStreams{In: os.Stdin, Out: out, Err: os.Stderr})
+	os.Args = []string{"show", "config", "show", "--format", "json"}
+	command, err := ProcessAllOptionsE(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RunCommand(cli, command); err != nil {
+		t.Fatal(err)
+	}
+	var shown TestScalarOptions
+	if err := json.Unmarshal(out.Bytes(), &shown); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (TestScalarOptions{Count: 3, Name: "root"}); shown != expected {
+		t.Errorf("Expected %#v but got %#v", expected, shown)
+	}
+
+	out.Reset()
+	cli = &TestConfigCommandCli{TestScalarCli{*New("show")}}
+	cli.SetStreams(IOStreams{In: os.Stdin, Out: out, Err: os.Stderr})
+	os.Args = []string{"show", "config", "explain", "--format", "json"}
+	if command, err = ProcessAllOptionsE(cli); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunCommand(cli, command); err != nil {
+		t.Fatal(err)
+	}
+	var got configExplanation
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	searched := map[string]bool{}
+	for _, path := range got.Searched {
+		searched[path.Path] = path.Exists
+	}
+	if !searched[dropIn] {
+		t.Errorf("Expected the drop-in as an existing candidate, got %#v", got.Searched)
+	}
+	if _, ok := searched[filepath.Dir(dropIn)]; ok {
+		t.Errorf("Expected the drop-in directory not to be searched, got %#v", got.Searched)
+	}
+	for _, value := range got.Options {
+		if value.Key == "count" && value.Source != "file "+dropIn {
+			t.Errorf("Expected count from %s, got %q", dropIn, value.Source)
+		}
+	}
+}
+
+func TestLoadConfigsErrors(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.Mkdir(".test.d", 0755)
+	config := filepath.Join(dir, ".test.d/config.yml")
+
+	ioutil.WriteFile(config, []byte("a: 1\nb: [\n"), 0644)
+	cli := &TestCli{*New("test")}
+	err := processConfigsE(cli)
+	if parseErr, ok := err.(ConfigParseError); !ok || parseErr.File != config || parseErr.Line == 0 {
+		t.Errorf("Expected ConfigParseError with line for %s, got %#v", config, err)
+	}
+
+	os.Remove(config)
+	ioutil.WriteFile(config, []byte("#!/bin/sh\necho oops >&2\nexit 3\n"), 0755)
+	cli = &TestCli{*New("test")}
+	err = processConfigsE(cli)
+	if execErr, ok := err.(ConfigExecError); !ok || execErr.ExitStatus != 3 || execErr.Stderr != "oops\n" {
+		t.Errorf("Expected ConfigExecError with exit status 3, got %#v", err)
+	}
+
+	os.Args = []string{os.Args[0], "--help"}
+	defer func() { os.Args = []string{os.Args[0]} }()
+	if _, err := ProcessAllOptionsE(&TestCli{*New("test")}); err != (Exit{0}) {
+		t.Errorf("Expected Exit{0} for --help, got %#v", err)
+	}
+}
+
+func TestLoadConfigsFormats(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.MkdirAll("sub/.test.d", 0755)
+	ioutil.WriteFile(filepath.Join(dir, "sub/.test.d/config.json"), []byte(`{"a": 1, "id": 9007199254740993, "list": ["json"]}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub/.test.d/config.yml"), []byte("a: 2\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub/.test.d/config.toml"), []byte("b = 3\nlist = [\"toml\"]\n"), 0644)
+	os.Mkdir(".test.d", 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.toml"), []byte("#!/bin/sh\necho '#format json'\necho '{\"c\": 4}'\n"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.hcl"), []byte("d = 5\nhash {\n  hoh {\n    A = \"b\"\n  }\n}\n"), 0644)
+	os.Chdir("sub")
+
+	cli := &TestCli{*New("test")}
+	if err := processConfigsE(cli); err != nil {
+		t.Fatal(err)
+	}
+	options := cli.GetOptions().(map[string]interface{})
+	// blocks are maps like in the other formats
+	if hash := fmt.Sprint(options["hash"]); hash != "map[hoh:map[A:b]]" {
+		t.Errorf("Expected the hcl blocks as maps, got %s", hash)
+	}
+	delete(options, "hash")
+	expected := map[string]interface{}{
+		"a":    2,
+		"b":    3,
+		"c":    4,
+		"d":    5,
+		"id":   9007199254740993,
+		"list": []interface{}{"toml", "json"},
+	}
+	if !reflect.DeepEqual(cli.GetOptions(), expected) {
+		t.Errorf("Expected %#v but got %#v", expected, cli.GetOptions())
+	}
+}
+
+func TestLoadConfigsInclude(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.MkdirAll(".test.d", 0755)
+	os.MkdirAll("team/extra", 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.yml"), []byte("a: 1\ninclude:\n  - ../team/base.yml\n  - ../team/extra/*.yml\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "team/base.yml"), []byte("a: 2\nb: 2\nc: 2\nlist: [base]\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "team/extra/1.yml"), []byte("b: 3\nlist: [one]\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "team/extra/2.yml"), []byte("b: 4\ninclude: ../base.yml\n"), 0644)
+
+	cli := &TestCli{*New("test")}
+	if err := processConfigsE(cli); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"a":    1,
+		"b":    4,
+		"c":    2,
+		"list": []interface{}{"base", "one"},
+	}
+	if !reflect.DeepEqual(cli.GetOptions(), expected) {
+		t.Errorf("Expected %#v but got %#v", expected, cli.GetOptions())
+	}
+	if source, _ := cli.GetSource("c"); source.File != filepath.Join(dir, "team/base.yml") {
+		t.Errorf("Expected c to come from team/base.yml, got %s", source)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "team/base.yml"), []byte("include: ../.test.d/config.yml\n"), 0644)
+	cli = &TestCli{*New("test")}
+	if err, ok := processConfigsE(cli).(ConfigIncludeError); !ok {
+		t.Errorf("Expected ConfigIncludeError for include cycle, got %#v", err)
+	}
+}
+
+func TestLoadConfigsConfigOnlyKeys(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.MkdirAll(".test.d", 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.yml"), []byte(`
+a: 1
+include: extra.yml
+aliases:
+  mine: list --mine
+custom-commands:
+  - name: greet
+    script: echo hello
+hooks:
+  pre-run:
+    - command: true
+auth:
+  example.com:
+    type: bearer
+retry:
+  max-retries: 1
+credential-store:
+  type: file
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/extra.yml"), []byte("b: 2\naliases:\n  todo: list --todo\n"), 0644)
+
+	cli := &TestCli{*New("test")}
+	if err := processConfigsE(cli); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"a": 1, "b": 2}
+	if !reflect.DeepEqual(cli.GetOptions(), expected) {
+		t.Errorf("Expected %#v but got %#v", expected, cli.GetOptions())
+	}
+	if source, ok := cli.GetSource("aliases"); ok {
+		t.Errorf("Expected no source for aliases, got %s", source)
+	}
+}
+
+func TestLoadConfigsDropIns(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.MkdirAll(".test.d/config.d", 0755)
+	os.MkdirAll("sub/.test.d/config.d", 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.yml"), []byte("a: 1\nb: 1\nc: 1\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.d/10-b.yml"), []byte("b: 10\nc: 10\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.d/20-c.json"), []byte(`{"c": 20}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.d/README"), []byte("ignored"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub/.test.d/config.yml"), []byte("a: 2\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub/.test.d/config.d/a.yml"), []byte("a: 3\n"), 0644)
+	os.Chdir("sub")
+
+	cli := &TestCli{*New("test")}
+	if err := processConfigsE(cli); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"a": 3, "b": 10, "c": 20}
+	if !reflect.DeepEqual(cli.GetOptions(), expected) {
+		t.Errorf("Expected %#v but got %#v", expected, cli.GetOptions())
+	}
+}
+
+type TestStrategyOptions struct {
+	Union    []string          `json:"union"`
+	Append   []string          `json:"append" cliby:"merge=append"`
+	Replace  []string          `json:"replace" cliby:"merge=replace"`
+	Hash     map[string]string `json:"hash" cliby:"merge=first"`
+	Closest  string            `json:"closest"`
+	Farthest string            `json:"farthest" cliby:"merge=last"`
+}
+
+type TestStrategyCli struct {
+	Cli
+}
+
+func (c *TestStrategyCli) NewOptions() interface{} {
+	return &TestStrategyOptions{}
+}
+
+func TestOptionMergeStrategies(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.MkdirAll("sub/.test.d", 0755)
+	os.Mkdir(".test.d", 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.yml"), []byte(`
+union: [a, b]
+append: [a, b]
+replace: [a, b]
+hash: {a: root, b: root}
+closest: root
+farthest: root
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub/.test.d/config.yml"), []byte(`
+union: [b, c]
+append: [b, c]
+replace: [b, c]
+hash: {a: sub}
+closest: sub
+farthest: sub
+`), 0644)
+	os.Chdir("sub")
+
+	cli := &TestStrategyCli{*New("test")}
+	cli.SetDefaults(&TestStrategyOptions{
+		Append:   []string{"c"},
+		Farthest: "default",
+	})
+	if err := processConfigsE(cli); err != nil {
+		t.Fatal(err)
+	}
+	expected := &TestStrategyOptions{
+		Union:    []string{"b", "c", "a"},
+		Append:   []string{"b", "c", "a", "b", "c"},
+		Replace:  []string{"b", "c"},
+		Hash:     map[string]string{"a": "sub"},
+		Closest:  "sub",
+		Farthest: "default",
+	}
+	if !reflect.DeepEqual(cli.GetOptions(), expected) {
+		t.Errorf("Expected %#v but got %#v", expected, cli.GetOptions())
+	}
+
+	// the command line and the environment win over merge=last configs
+	cli = &TestStrategyCli{*New("test")}
+	cli.SetOptions(&TestStrategyOptions{Farthest: "cmdline"})
+	cli.SetDefaults(&TestStrategyOptions{Farthest: "default"})
+	if err := processConfigsE(cli); err != nil {
+		t.Fatal(err)
+	}
+	if farthest := cli.GetOptions().(*TestStrategyOptions).Farthest; farthest != "cmdline" {
+		t.Errorf("Expected farthest from the command line, got %q", farthest)
+	}
+	os.Setenv("TEST_FARTHEST", "env")
+	defer os.Unsetenv("TEST_FARTHEST")
+	cli = &TestStrategyCli{*New("test")}
+	cli.SetDefaults(&TestStrategyOptions{Farthest: "default"})
+	if err := processConfigsE(cli); err != nil {
+		t.Fatal(err)
+	}
+	if farthest := cli.GetOptions().(*TestStrategyOptions).Farthest; farthest != "env" {
+		t.Errorf("Expected farthest from the environment, got %q", farthest)
+	}
+}
+
+type TestScalarOptions struct {
+	Edit    bool    `json:"edit"`
+	Count   int     `json:"count"`
+	Ratio   float64 `json:"ratio"`
+	Name    string  `json:"name"`
+	Inherit string  `json:"inherit"`
+}
+
+type TestScalarCli struct {
+	Cli
+}
+
+func (c *TestScalarCli) NewOptions() interface{} {
+	return &TestScalarOptions{}
+}
+
+func TestOptionMergeZeroValues(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.MkdirAll("sub/.test.d", 0755)
+	os.Mkdir(".test.d", 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.yml"), []byte("edit: true\ncount: 5\nratio: 0.5\nname: root\ninherit: root\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub/.test.d/config.yml"), []byte("edit: false\ncount: 0\nratio: 0\nname: \"\"\n"), 0644)
+	os.Chdir("sub")
+
+	cli := &TestScalarCli{*New("test")}
+	cli.SetDefaults(&TestScalarOptions{
+		Edit:    true,
+		Count:   3,
+		Ratio:   1.5,
+		Name:    "default",
+		Inherit: "default",
+	})
+	if err := processConfigsE(cli); err != nil {
+		t.Fatal(err)
+	}
+	expected := &TestScalarOptions{Inherit: "root"}
+	if !reflect.DeepEqual(cli.GetOptions(), expected) {
+		t.Errorf("Expected %#v but got %#v", expected, cli.GetOptions())
+	}
+
+	// a zero value set on the options before processing is not
+	// distinguishable from unset, but a non-zero one still wins over every
+	// config
+	os.Remove(filepath.Join(dir, "sub/.test.d/config.yml"))
+	cli = &TestScalarCli{*New("test")}
+	cli.SetOptions(&TestScalarOptions{Name: "cmdline"})
+	cli.SetDefaults(&TestScalarOptions{Edit: false, Count: 3})
+	if err := processConfigsE(cli); err != nil {
+		t.Fatal(err)
+	}
+	expected = &TestScalarOptions{Edit: true, Count: 5, Ratio: 0.5, Name: "cmdline", Inherit: "root"}
+	if !reflect.DeepEqual(cli.GetOptions(), expected) {
+		t.Errorf("Expected %#v but got %#v", expected, cli.GetOptions())
+	}
+
+	// zero values given to flags registered by hand are set from the
+	// command line, the cli has its own name so that the variables it
+	// exports do not leak into the other tests
+	os.Mkdir(filepath.Join(dir, ".flags.d"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".flags.d/config.yml"), []byte("edit: true\ncount: 5\nname: root\ncommands:\n  list:\n    count: 7\n"), 0644)
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{"test", "--no-edit", "--name=", "list", "--count", "0"}
+	flagCli := &TestScalarFlagCli{TestScalarCli{*New("flags")}}
+	flagCli.SetOptions(&TestScalarOptions{})
+	list := &TestScalarOptions{}
+	flagCli.RegisterCommand(&Command{Name: "list", Options: list})
+	if _, err := ProcessAllOptionsE(flagCli); err != nil {
+		t.Fatal(err)
+	}
+	expected = &TestScalarOptions{Count: 5}
+	if !reflect.DeepEqual(flagCli.GetOptions(), expected) {
+		t.Errorf("Expected %#v but got %#v", expected, flagCli.GetOptions())
+	}
+	if list.Count != 0 {
+		t.Errorf("Expected the list count from the command line, got %d", list.Count)
+	}
+	for _, key := range []string{"edit", "name", "commands.list.count"} {
+		if source, _ := flagCli.GetSource(key); source.Kind != SourceCommandLine {
+			t.Errorf("Expected %s to come from the command line, got %s", key, source)
+		}
+	}
+}
+
+type TestScalarFlagCli struct {
+	TestScalarCli
+}
+
+func (c *TestScalarFlagCli) CommandLine() *kingpin.Application {
+	options := c.GetOptions().(*TestScalarOptions)
+	list := c.GetRegisteredCommands()["list"].Options.(*TestScalarOptions)
+	app := kingpin.New("flags", "")
+	app.Flag("edit", "").BoolVar(&options.Edit)
+	app.Flag("name", "").StringVar(&options.Name)
+	app.Command("list", "").Flag("count", "").IntVar(&list.Count)
+	return app
+}
+
+type TestEnvOptions struct {
+	Edit      bool              `json:"edit"`
+	Count     int               `json:"count"`
+	Ratio     float64           `json:"ratio"`
+	Name      string            `json:"name"`
+	Labels    []string          `json:"labels"`
+	QueryArgs map[string]string `json:"query-args"`
+}
+
+type TestEnvCli struct {
+	Cli
+}
+
+func (c *TestEnvCli) NewOptions() interface{} {
+	return &TestEnvOptions{}
+}
+
+func TestOptionEnv(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.Mkdir(".test.d", 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.yml"), []byte("edit: true\ncount: 5\nratio: 0.5\nname: config\nlabels: [config]\n"), 0644)
+
+	env := map[string]string{
+		"TEST_EDIT":       "false",
+		"TEST_COUNT":      "0",
+		"TEST_RATIO":      "2.5",
+		"TEST_NAME":       "env",
+		"TEST_LABELS":     `["env"]`,
+		"TEST_QUERY_ARGS": `{"a": "b"}`,
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	cli := &TestEnvCli{*New("test")}
+	cli.SetOptions(&TestEnvOptions{Name: "cmdline"})
+	if err := processConfigsE(cli); err != nil {
+		t.Fatal(err)
+	}
+	expected := &TestEnvOptions{
+		Ratio:     2.5,
+		Name:      "cmdline",
+		Labels:    []string{"env", "config"},
+		QueryArgs: map[string]string{"a": "b"},
+	}
+	if !reflect.DeepEqual(cli.GetOptions(), expected) {
+		t.Errorf("Expected %#v but got %#v", expected, cli.GetOptions())
+	}
+	if source, _ := cli.GetSource("count"); source != (ConfigSource{Kind: SourceEnv, Env: "TEST_COUNT"}) {
+		t.Errorf("Expected count to come from TEST_COUNT, got %s", source)
+	}
+
+	os.Setenv("TEST_COUNT", "many")
+	cli = &TestEnvCli{*New("test")}
+	if err, ok := processConfigsE(cli).(EnvParseError); !ok || err.Name != "TEST_COUNT" {
+		t.Errorf("Expected EnvParseError for TEST_COUNT, got %#v", err)
+	}
+
+	os.Setenv("TEST_COUNT", "7")
+	cli = &TestEnvCli{*New("test")}
+	cli.SetOptions(TestEnvOptions{Name: "value"})
+	if err := loadEnv(cli, &mergeState{}); err != nil {
+		t.Fatal(err)
+	}
+	// the other variables now hold the values exported above and are ignored
+	expectedValue := TestEnvOptions{Count: 7, Name: "value"}
+	if !reflect.DeepEqual(cli.GetOptions(), expectedValue) {
+		t.Errorf("Expected %#v but got %#v", expectedValue, cli.GetOptions())
+	}
+
+	// an empty variable sets an empty value, and variables exported by a
+	// parent process are ignored unless they were changed since
+	for name := range env {
+		os.Unsetenv(name)
+	}
+	os.Setenv("TEST_NAME", "")
+	os.Setenv("TEST_COUNT", "7")
+	os.Setenv("TEST_RATIO", "3.5")
+	defer os.Setenv("TEST_EXPORTED_ENV", os.Getenv("TEST_EXPORTED_ENV"))
+	os.Setenv("TEST_EXPORTED_ENV", `{"TEST_COUNT": "7", "TEST_RATIO": "2.5"}`)
+	cli = &TestEnvCli{*New("test")}
+	if err := processConfigsE(cli); err != nil {
+		t.Fatal(err)
+	}
+	expected = &TestEnvOptions{Edit: true, Count: 5, Ratio: 3.5, Labels: []string{"config"}}
+	if !reflect.DeepEqual(cli.GetOptions(), expected) {
+		t.Errorf("Expected %#v but got %#v", expected, cli.GetOptions())
+	}
+	if source, _ := cli.GetSource("name"); source != (ConfigSource{Kind: SourceEnv, Env: "TEST_NAME"}) {
+		t.Errorf("Expected name to come from TEST_NAME, got %s", source)
+	}
+	exported := make(map[string]string)
+	if err := json.Unmarshal([]byte(os.Getenv("TEST_EXPORTED_ENV")), &exported); err != nil || exported["TEST_RATIO"] != "3.500000" || exported["TEST_NAME"] != "" {
+		t.Errorf("Expected the exported variables in TEST_EXPORTED_ENV, got %q", os.Getenv("TEST_EXPORTED_ENV"))
+	}
+}
+
+type TestFlagOptions struct {
+	Project   string            `json:"project" cliby:"help='Project key',short=p,env=PROJECT,required"`
+	Verbose   bool              `json:"verbose"`
+	MaxCount  int               `cliby:"short=m"`
+	Labels    []string          `json:"labels"`
+	QueryArgs map[string]string `json:"query-args"`
+	Filter    map[string]int    `json:"filter"`
+	Internal  string            `json:"internal" cliby:"noflag"`
+}
+
+type TestFlagCli struct {
+	Cli
+}
+
+func (c *TestFlagCli) NewOptions() interface{} {
+	return &TestFlagOptions{}
+}
+
+func TestBindFlags(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.Mkdir(".test.d", 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.yml"), []byte("project: config\nverbose: true\ninternal: config\n"), 0644)
+
+	cli := &TestFlagCli{*New("test")}
+	app := kingpin.New("test", "")
+	if err := BindFlags(cli, app); err != nil {
+		t.Fatal(err)
+	}
+	if app.GetFlag("internal") != nil {
+		t.Errorf("Expected no flag for noflag option")
+	}
+	if app.GetFlag("maxcount") == nil {
+		t.Errorf("Expected the flag of an untagged option to match its config key")
+	}
+	if _, err := app.Parse([]string{"-p", "flag", "--no-verbose", "-m", "3", "--labels", "a", "--labels", "b", "--query-args", "a=b", "--filter", `{"x":1}`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := processConfigsE(cli); err != nil {
+		t.Fatal(err)
+	}
+	expected := &TestFlagOptions{
+		Project:   "flag",
+		MaxCount:  3,
+		Labels:    []string{"a", "b"},
+		QueryArgs: map[string]string{"a": "b"},
+		Filter:    map[string]int{"x": 1},
+		Internal:  "config",
+	}
+	if !reflect.DeepEqual(cli.GetOptions(), expected) {
+		t.Errorf("Expected %#v but got %#v", expected, cli.GetOptions())
+	}
+	if source, _ := cli.GetSource("verbose"); source.Kind != SourceCommandLine {
+		t.Errorf("Expected verbose to come from the command line, got %s", source)
+	}
+
+	os.Remove(filepath.Join(dir, ".test.d/config.yml"))
+	cli = &TestFlagCli{*New("test")}
+	app = kingpin.New("test", "")
+	BindFlags(cli, app)
+	if _, err := app.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := processConfigsE(cli).(MissingOptionError); !ok || err.Flag != "--project" || err.Env != "PROJECT" {
+		t.Errorf("Expected MissingOptionError for project, got %#v", err)
+	}
+}
+
+type TestIssueOptions struct {
+	Repo string `json:"repo"`
+}
+
+type TestCreateOptions struct {
+	Project string   `json:"project"`
+	Type    string   `json:"type"`
+	Edit    bool     `json:"edit"`
+	Labels  []string `json:"labels"`
+}
+
+func TestCommandTree(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.Mkdir(".test.d", 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.yml"), []byte(`
+project: global
+edit: true
+commands:
+  issue:
+    project: issue
+    repo: main
+    type: Task
+    create:
+      type: Bug
+      labels: [config]
+`), 0644)
+
+	cli := &TestFlagCli{*New("test")}
+	cli.SetOptions(&TestFlagOptions{})
+	issue := &TestIssueOptions{}
+	create := &TestCreateOptions{}
+	ran := ""
+	cli.RegisterCommand(&Command{Name: "issue", Help: "Manage issues", Options: issue})
+	cli.RegisterCommand(&Command{Name: "issue create", Help: "Create an issue", Options: create, Run: func() error {
+		ran = "issue create"
+		return nil
+	}})
+	cli.RegisterCommand(&Command{Name: "issue list", Help: "List issues"})
+
+	app := kingpin.New("test", "")
+	if err := BindCommands(cli, app); err != nil {
+		t.Fatal(err)
+	}
+	command, err := app.Parse([]string{"issue", "create", "--labels", "flag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command != "issue create" {
+		t.Fatalf("Expected command issue create, got %q", command)
+	}
+	if err := processCommandConfigsE(cli, command); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (&TestIssueOptions{Repo: "main"}); !reflect.DeepEqual(issue, expected) {
+		t.Errorf("Expected %#v but got %#v", expected, issue)
+	}
+	expected := &TestCreateOptions{Project: "issue", Type: "Bug", Edit: false, Labels: []string{"flag", "config"}}
+	if !reflect.DeepEqual(create, expected) {
+		t.Errorf("Expected %#v but got %#v", expected, create)
+	}
+	if source, _ := cli.GetSource("commands.issue.create.labels"); source.Kind != SourceCommandLine {
+		t.Errorf("Expected labels to come from the command line, got %s", source)
+	}
+	if err := RunCommand(cli, command); err != nil || ran != "issue create" {
+		t.Errorf("Expected issue create to run, got %q: %v", ran, err)
+	}
+
+	cli.SetOptions(&TestFlagOptions{})
+	issue = &TestIssueOptions{}
+	create = &TestCreateOptions{}
+	cli.RegisterCommand(&Command{Name: "issue", Options: issue})
+	cli.RegisterCommand(&Command{Name: "issue create", Options: create})
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.yml"), []byte("project: global\nedit: true\n"), 0644)
+	if err := processCommandConfigsE(cli, "issue create"); err != nil {
+		t.Fatal(err)
+	}
+	expected = &TestCreateOptions{Project: "global"}
+	if !reflect.DeepEqual(create, expected) {
+		t.Errorf("Expected %#v but got %#v", expected, create)
+	}
+	if source, _ := cli.GetSource("commands.issue.create.project"); source.File == "" {
+		t.Errorf("Expected project to come from the global config, got %s", source)
+	}
+}
+
+func TestRunHandler(t *testing.T) {
+	cli := &TestFlagCli{*New("test")}
+	out := &bytes.Buffer{}
+	cli.SetStreams(IOStreams{In: os.Stdin, Out: out, Err: out})
+	create := &TestCreateOptions{Type: "Bug"}
+	cli.RegisterCommand(&Command{Name: "issue create", Options: create, Handler: func(ctx context.Context, options interface{}, streams IOStreams) error {
+		fmt.Fprintf(streams.Out, "type: %s", options.(*TestCreateOptions).Type)
+		return nil
+	}})
+	if err := RunCommand(cli, "issue create"); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "type: Bug" {
+		t.Errorf("Expected handler output, got %q", out.String())
+	}
+
+	cli.AddHandler("wait", func(ctx context.Context, options interface{}, streams IOStreams) error {
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return fmt.Errorf("context was not cancelled")
+		}
+	})
+	err := RunCommand(cli, "wait")
+	if _, ok := err.(Interrupted); !ok {
+		t.Fatalf("Expected Interrupted, got %#v", err)
+	}
+	if code := ExitCode(err); code != 130 {
+		t.Errorf("Expected exit code 130, got %d", code)
+	}
+}
+
+func TestRunHandlerSecondInterrupt(t *testing.T) {
+	if os.Getenv("CLIBY_TEST_IGNORE_CONTEXT") != "" {
+		// run in a child process, the second SIGINT kills it
+		cli := New("test")
+		cli.AddHandler("stubborn", func(ctx context.Context, options interface{}, streams IOStreams) error {
+			fmt.Println("ready")
+			<-ctx.Done()
+			fmt.Println("cancelled")
+			time.Sleep(10 * time.Second)
+			return nil
+		})
+		RunCommand(cli, "stubborn")
+		os.Exit(0)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRunHandlerSecondInterrupt$")
+	cmd.Env = append(os.Environ(), "CLIBY_TEST_IGNORE_CONTEXT=1")
+	stdout, _ := cmd.StdoutPipe()
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	lines := bufio.NewScanner(stdout)
+	for _, expected := range []string{"ready", "cancelled"} {
+		for lines.Scan() && lines.Text() != expected {
+		}
+		cmd.Process.Signal(syscall.SIGINT)
+	}
+	start := time.Now()
+	err := cmd.Wait()
+	status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() || status.Signal() != syscall.SIGINT {
+		t.Errorf("Expected the second SIGINT to kill the handler, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Expected the handler to be killed right away, took %s", time.Since(start))
+	}
+}
+
+type TestListOptions struct {
+	Assignee string `json:"assignee"`
+}
+
+func TestCommandAliases(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.Mkdir(".test.d", 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.yml"), []byte(`
+aliases:
+  mine: "issue list --assignee 'me myself'"
+  bugs: [is, cr, --type, Bug]
+`), 0644)
+
+	cli := &TestFlagCli{*New("test")}
+	cli.RegisterCommand(&Command{Name: "issue create", Aliases: []string{"new"}, Options: &TestCreateOptions{}, Run: func() error { return nil }})
+	cli.RegisterCommand(&Command{Name: "issue close", Run: func() error { return nil }})
+	cli.RegisterCommand(&Command{Name: "issue list", Options: &TestListOptions{}, Run: func() error { return nil }})
+	cli.AddCommand("login", func() error { return nil })
+	cli.AddCommandAlias("issue ls", "issue list")
+
+	app := kingpin.New("test", "")
+	app.Flag("user", "").Short('u').String()
+	app.Command("login", "")
+	BindCommands(cli, app)
+
+	for args, expected := range map[string]string{
+		"mine":                  "issue list --assignee me myself",
+		"bugs --edit":           "issue create --type Bug --edit",
+		"-u iss ls":             "-u iss ls",
+		"-u iss is ls":          "-u iss issue list",
+		"-u me is ls":           "-u me issue list",
+		"lo":                    "login",
+		"issue new --type Task": "issue new --type Task",
+		"is cr -- mine":         "issue create -- mine",
+	} {
+		got, err := expandArgs(cli, app, strings.Fields(args))
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %s", args, err)
+			continue
+		}
+		if strings.Join(got, " ") != expected {
+			t.Errorf("Expected %q to expand to %q, got %q", args, expected, got)
+		}
+	}
+	if _, err := expandArgs(cli, app, []string{"issue", "c"}); err == nil || !strings.Contains(err.Error(), "issue close, issue create") {
+		t.Errorf("Expected ambiguous command error, got %v", err)
+	}
+
+	for command, expected := range map[string]string{
+		"is cr":     "issue create",
+		"issue new": "issue create",
+		"i l":       "issue list",
+		"lo":        "login",
+		"unknown":   "unknown",
+	} {
+		if got, err := resolveCommand(cli, command); err != nil || got != expected {
+			t.Errorf("Expected %q to resolve to %q, got %q: %v", command, expected, got, err)
+		}
+	}
+	if _, err := resolveCommand(cli, "is c"); err == nil {
+		t.Errorf("Expected is c to be ambiguous")
+	}
+}
+
+func TestConfigAliasesInclude(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.MkdirAll(".test.d/config.d", 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.yml"), []byte(`
+include: [aliases.yml, more.yml]
+aliases:
+  mine: list --mine
+  hidden!: null
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/aliases.yml"), []byte(`
+aliases:
+  mine: list --theirs
+  todo: list --todo
+  shared: list --first
+  hidden: list --hidden
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/more.yml"), []byte(`
+aliases:
+  shared: list --last
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.d/10-extra.yml"), []byte(`
+aliases:
+  extra: list --extra
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.d/20-exec.yml"), []byte(`#!/bin/sh
+echo ran >> "`+filepath.Join(dir, "ran")+`"
+echo "aliases: {exec: list --exec}"
+`), 0755)
+
+	cli := &TestFlagCli{*New("test")}
+	cli.SetOptions(&TestFlagOptions{})
+	expected := map[string][]string{
+		"mine":   {"list", "--mine"},
+		"todo":   {"list", "--todo"},
+		"shared": {"list", "--last"},
+		"extra":  {"list", "--extra"},
+		"exec":   {"list", "--exec"},
+	}
+	if got := loadConfigAliases(cli); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected aliases %q, got %q", expected, got)
+	}
+
+	// the configs read for the aliases are merged without running the
+	// executable config again
+	if err := loadConfigs(cli, ".test.d/config.yml", &mergeState{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadConfigAliases(cli); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected aliases %q, got %q", expected, got)
+	}
+	if ran, _ := ioutil.ReadFile(filepath.Join(dir, "ran")); string(ran) != "ran\n" {
+		t.Errorf("Expected the executable config to run once, got %q", ran)
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	cli := &TestFlagCli{*New("test")}
+	cli.RegisterCommand(&Command{Name: "issue create", Aliases: []string{"new"}, Run: func() error { return nil }})
+	cli.RegisterCommand(&Command{Name: "issue close", Run: func() error { return nil }})
+	cli.RegisterCommand(&Command{Name: "issue delete", Run: func() error { return nil }})
+	cli.RegisterCommand(&Command{Name: "secret", Hidden: true, Run: func() error { return nil }})
+	app := kingpin.New("test", "")
+	BindCommands(cli, app)
+
+	_, err := expandArgs(cli, app, []string{"issue", "craete"})
+	expected := UnknownCommandError{Name: "issue craete", Suggestions: []string{"issue create"}}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, err)
+	}
+	_, err = expandArgs(cli, app, []string{"isue"})
+	expected = UnknownCommandError{Name: "isue", Suggestions: []string{"issue"}}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, err)
+	}
+	if _, err := expandArgs(cli, app, []string{"help", "issue"}); err != nil {
+		t.Errorf("Expected help to be passed through, got %s", err)
+	}
+	if got := suggestCommands("issue clos", []string{"issue close", "issue create", "issue delete", "issue new"}); !reflect.DeepEqual(got, []string{"issue close"}) {
+		t.Errorf("Expected issue close suggestion, got %q", got)
+	}
+	if got := suggestCommands("secre", []string{"issue close", "secret"}); !reflect.DeepEqual(got, []string{"secret"}) {
+		t.Errorf("Expected secret suggestion, got %q", got)
+	}
+	for command, expected := range map[string][]string{
+		"logn":  {"login"},
+		"lgoin": {},
+		"ls":    {},
+		"tus":   {"status"},
+		"x":     {},
+	} {
+		if got := suggestCommands(command, []string{"issue", "login", "status"}); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected suggestions %q for %s, got %q", expected, command, got)
+		}
+	}
+}
+
+func TestPlugins(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.MkdirAll(".test.d/plugins", 0755)
+	os.Mkdir("bin", 0755)
+	script := "#!/bin/sh\necho \"args: $*\"\necho \"name: $TEST_NAME\"\ncat \"$TEST_OPTIONS_FILE\"\n"
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/plugins/test-hello"), []byte(script), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "bin/test-hello"), []byte("#!/bin/sh\nexit 3\n"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "bin/test-fail"), []byte("#!/bin/sh\nexit 3\n"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "bin/test-data"), []byte("not executable"), 0644)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", strings.Join([]string{filepath.Join(dir, "bin"), "/bin", "/usr/bin"}, string(os.PathListSeparator)))
+
+	cli := &TestEnvCli{*New("test")}
+	out := &bytes.Buffer{}
+	cli.SetStreams(IOStreams{In: os.Stdin, Out: out, Err: out})
+	cli.RegisterCommand(&Command{Name: "issue create", Run: func() error { return nil }})
+	app := kingpin.New("test", "")
+	BindCommands(cli, app)
+
+	args, err := expandArgs(cli, app, []string{"hello", "--flag", "a", "--", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	command, err := app.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetOptions(&TestEnvOptions{Name: "plugin"})
+	if err := processCommandConfigsE(cli, command); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunCommand(cli, command); err != nil {
+		t.Fatal(err)
+	}
+	expected := "args: --flag a -- b\nname: plugin\n" + `{"edit":false,"count":0,"ratio":0,"name":"plugin","labels":null,"query-args":null}` + "\n"
+	if out.String() != expected {
+		t.Errorf("Expected plugin output %q, got %q", expected, out.String())
+	}
+
+	if err := RunCommand(cli, "fail"); ExitCode(err) != 3 {
+		t.Errorf("Expected exit status 3, got %v", err)
+	}
+
+	out.Reset()
+	if err := ListPlugins(cli, out); err != nil {
+		t.Fatal(err)
+	}
+	expected = fmt.Sprintf("fail\t%s/bin/test-fail\nhello\t%s/.test.d/plugins/test-hello\n", dir, dir)
+	if !strings.HasPrefix(out.String(), expected) {
+		t.Errorf("Expected plugin list %q, got %q", expected, out.String())
+	}
+}
+
+func TestCustomCommands(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.MkdirAll("sub/.test.d", 0755)
+	os.Mkdir(".test.d", 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.yml"), []byte(`
+custom-commands:
+  - name: greet
+    help: Say hello
+    script: echo far
+  - name: issue mine
+    script: echo mine
+  - name: login
+    script: echo custom login
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub/.test.d/config.yml"), []byte(`
+name: config
+custom-commands:
+  - name: greet
+    help: Say hello
+    options:
+      - name: loud
+        short: l
+        type: bool
+      - name: greeting
+        default: hello
+    args:
+      - name: who
+        required: true
+      - name: more
+        repeat: true
+    script: |
+      echo {{shellquote .options.greeting}} {{shellquote .args.who}} {{shellquote .args.more}} loud={{.options.loud}} name=$TEST_NAME {{shellquote .global.Name}}
+  - name: fail
+    script: exit 4
+`), 0644)
+	os.Chdir("sub")
+
+	cli := &TestEnvCli{*New("test")}
+	out := &bytes.Buffer{}
+	cli.SetStreams(IOStreams{In: os.Stdin, Out: out, Err: out})
+	cli.AddCommand("login", func() error { return nil })
+	app := kingpin.New("test", "")
+	app.Command("login", "")
+	bindCustomCommands(cli, app)
+
+	command, err := app.Parse([]string{"greet", "-l", "world", "a $(echo b)", "'c'"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := processCommandConfigsE(cli, command); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunCommand(cli, command); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "hello world a $(echo b) 'c' loud=true name=config config\n"; out.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, out.String())
+	}
+
+	out.Reset()
+	if err := RunCommand(cli, "issue mine"); err != nil || out.String() != "mine\n" {
+		t.Errorf("Expected issue mine to run, got %q: %v", out.String(), err)
+	}
+	if err := RunCommand(cli, "fail"); ExitCode(err) != 4 {
+		t.Errorf("Expected exit status 4, got %v", err)
+	}
+	if _, err := app.Parse([]string{"greet"}); err == nil {
+		t.Errorf("Expected error for missing required argument")
+	}
+}
+
+func TestCustomCommandsProcessedTwice(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.Mkdir(".test.d", 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.yml"), []byte(`
+project: ABC
+custom-commands:
+  - name: greet
+    args:
+      - name: who
+    script: echo hello {{shellquote .args.who}}
+  - name: legacy
+    script: echo custom legacy
+  - name: handled
+    script: echo custom handled
+`), 0644)
+	defer func(args []string) { os.Args = args }(os.Args)
+
+	cli := &TestCompletionCli{*New("test")}
+	out := &bytes.Buffer{}
+	cli.SetStreams(IOStreams{In: os.Stdin, Out: out, Err: out})
+	cli.AddCommand("legacy", func() error {
+		fmt.Fprintln(out, "legacy")
+		return nil
+	})
+	cli.AddHandler("handled", func(ctx context.Context, _ interface{}, streams IOStreams) error {
+		fmt.Fprintln(streams.Out, "handled")
+		return nil
+	})
+
+	for _, who := range []string{"world", "again"} {
+		os.Args = []string{"test", "greet", who}
+		command, err := ProcessAllOptionsE(cli)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := RunCommand(cli, command); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, command := range []string{"legacy", "handled"} {
+		if err := RunCommand(cli, command); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected := "hello world\nhello again\nlegacy\nhandled\n"; out.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, out.String())
+	}
+}
+
+type TestCompletionCli struct {
+	Cli
+}
+
+func (c *TestCompletionCli) NewOptions() interface{} {
+	return &TestFlagOptions{}
+}
+
+func (c *TestCompletionCli) CommandLine() *kingpin.Application {
+	app := kingpin.New("test", "")
+	BindFlags(c, app)
+	BindCommands(c, app)
+	AddCompletionCommand(c, app)
+	return app
+}
+
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	fn()
+	w.Close()
+	out, _ := ioutil.ReadAll(r)
+	return string(out)
+}
+
+func TestCompletion(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.Mkdir(".test.d", 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.yml"), []byte(`
+aliases:
+  mine: issue list --assignee me
+custom-commands:
+  - name: greet
+    script: echo hello
+`), 0644)
+	defer func(args []string) { os.Args = args }(os.Args)
+
+	cli := &TestCompletionCli{*New("test")}
+	cli.RegisterCommand(&Command{Name: "issue list", Options: &TestListOptions{}, Run: func() error { return nil }})
+	cli.AddCompleter("project", func() []string { return []string{"ABC", "XYZ"} })
+	cli.AddCompleter("commands.issue.list.assignee", func() []string { return []string{"me", "you"} })
+
+	for args, expected := range map[string][]string{
+		"--completion-bash":                         {"completion", "greet", "help", "issue", "mine"},
+		"--completion-bash --project A":             {"ABC", "XYZ"},
+		"--completion-bash issue list --assignee m": {"me", "you"},
+		"--completion-bash completion z":            {"bash", "fish", "zsh"},
+	} {
+		os.Args = append([]string{"test"}, strings.Fields(args)...)
+		var err error
+		out := captureStdout(t, func() {
+			_, err = ProcessAllOptionsE(cli)
+		})
+		if err != (Exit{0}) {
+			t.Errorf("Expected Exit{0} for %q, got %#v", args, err)
+		}
+		got := strings.Fields(out)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected completions %q for %q, got %q", expected, args, got)
+		}
+	}
+
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		out := &bytes.Buffer{}
+		if err := WriteCompletion(cli, shell, out); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), "test --completion-bash") && !strings.Contains(out.String(), `" --completion-bash`) {
+			t.Errorf("Expected %s script to call --completion-bash, got %s", shell, out.String())
+		}
+	}
+	if err := WriteCompletion(cli, "csh", ioutil.Discard); err == nil {
+		t.Errorf("Expected error for unknown shell")
+	}
+}
+
+func TestGenerateDocs(t *testing.T) {
+	cli := &TestFlagCli{*New("test")}
+	cli.SetDefaults(&TestFlagOptions{MaxCount: 10})
+	cli.SetTemplates(map[string]string{"list": "{{ range .issues }}{{ .key }}\n{{ end }}"})
+	cli.RegisterCommand(&Command{Name: "issue", Help: "Manage issues"})
+	cli.RegisterCommand(&Command{Name: "issue create", Help: "Create an issue", Options: &TestCreateOptions{}})
+	cli.RegisterCommand(&Command{Name: "secret", Hidden: true})
+	cli.AddCommand("legacy", func() error { return nil })
+
+	app := kingpin.New("test", "A test tool")
+	BindFlags(cli, app)
+	BindCommands(cli, app)
+	AddDocsCommand(cli, app)
+	app.GetCommand("issue").GetCommand("create").Arg("summary", "Issue summary | title\nshown in lists").Required().String()
+
+	dir := t.TempDir()
+	for _, format := range []string{"man", "markdown"} {
+		if err := GenerateDocs(cli, app, format, dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	for n := range files {
+		files[n] = filepath.Base(files[n])
+	}
+	expected := []string{"test-issue-create.1", "test-issue-create.md", "test-issue.1", "test-issue.md", "test.1", "test.md"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected pages %q, got %q", expected, files)
+	}
+
+	for file, contains := range map[string][]string{
+		"test.md": {
+			"A test tool",
+			"* [issue](test-issue.md) - Manage issues",
+			"* legacy",
+			"| `-p`, `--project` `PROJECT` | Project key |  |",
+			"| `maxcount` | `--maxcount` | `TEST_MAX_COUNT` | int |  | 10 |",
+			"| `internal` |  | `TEST_INTERNAL` | string |  |  |",
+			"### list",
+		},
+		"test-issue-create.md": {
+			"test [<flags>] issue create [<flags>] <summary>",
+			"| `summary` | Issue summary \\| title<br>shown in lists | yes |",
+			"`commands.issue.create`",
+			"* [test-issue](test-issue.md)",
+		},
+		"test.1": {
+			`.TH "TEST" "1" "" "test" "test Manual"`,
+			`\fB\-p\fR, \fB\-\-project\fR \fIPROJECT\fR`,
+			".BR test-issue (1)",
+			".B list\n.nf\n{{ range .issues }}{{ .key }}\n{{ end }}\n.fi",
+		},
+		"test-issue-create.1": {
+			`test-issue-create \- Create an issue`,
+			".B test [<flags>] issue create [<flags>] <summary>",
+		},
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range contains {
+			if !strings.Contains(string(content), expected) {
+				t.Errorf("Expected %s to contain %q, got:\n%s", file, expected, content)
+			}
+		}
+		if strings.Contains(string(content), "secret") || strings.Contains(string(content), "generate-docs") {
+			t.Errorf("Expected %s not to document hidden commands", file)
+		}
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.MkdirAll("sub/.test.d", 0755)
+	os.Mkdir(".test.d", 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".test.d/config.yml"), []byte(`
+hooks:
+  pre-run:
+    - echo "far pre $TEST_OPERATION"
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub/.test.d/config.yml"), []byte(`
+hooks:
+  pre-run:
+    - run: echo "issue pre $TEST_OPERATION"
+      command: issue
+  post-run:
+    - echo "post $TEST_OPERATION $TEST_EXIT_STATUS"
+`), 0644)
+	os.Chdir("sub")
+
+	cli := &TestFlagCli{*New("test")}
+	out := &bytes.Buffer{}
+	cli.SetStreams(IOStreams{In: os.Stdin, Out: out, Err: out})
+	cli.AddPreRunHook("", func(ctx context.Context, command string) error {
+		fmt.Fprintf(out, "global pre %s\n", command)
+		return nil
+	})
+	cli.AddPostRunHook("", func(ctx context.Context, command string, err error) error {
+		fmt.Fprintf(out, "global post %s %v\n", command, err)
+		return nil
+	})
+	cli.RegisterCommand(&Command{
+		Name: "issue create",
+		Handler: func(ctx context.Context, options interface{}, streams IOStreams) error {
+			fmt.Fprintln(streams.Out, "run")
+			return Exit{2}
+		},
+		PreRun: func(ctx context.Context, command string) error {
+			fmt.Fprintf(out, "command pre %s\n", command)
+			return nil
+		},
+		PostRun: func(ctx context.Context, command string, err error) error {
+			fmt.Fprintf(out, "command post %s %v\n", command, err)
+			return nil
+		},
+	})
+	cli.AddCommand("login", func() error {
+		fmt.Fprintln(out, "login")
+		return nil
+	})
+
+	if err := RunCommand(cli, "issue create"); err != (Exit{2}) {
+		t.Errorf("Expected Exit{2}, got %#v", err)
+	}
+	expected := `global pre issue create
+far pre issue create
+issue pre issue create
+command pre issue create
+run
+command post issue create exit status 2
+post issue create 2
+global post issue create exit status 2
+`
+	if out.String() != expected {
+		t.Errorf("Expected hooks output %q, got %q", expected, out.String())
+	}
+
+	out.Reset()
+	ioutil.WriteFile(filepath.Join(dir, "sub/.test.d/config.yml"), []byte(`
+hooks!:
+  pre-run:
+    - exit 3
+`), 0644)
+	// hooks are read again along with the options
+	cli.SetOptions(&TestFlagOptions{})
+	if err := LoadConfigsE(cli, ".test.d/config.yml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunCommand(cli, "login"); err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("Expected pre-run hook error, got %v", err)
+	}
+	if expected := "global pre login\n"; out.String() != expected {
+		t.Errorf("Expected hooks output %q, got %q", expected, out.String())
+	}
+}
+
+func TestRunHooksInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.Mkdir(".test.d", 0755)
+	ioutil.WriteFile(".test.d/config.yml", []byte(`
+hooks:
+  post-run:
+    - sleep 0.1; echo "post $TEST_OPERATION $TEST_EXIT_STATUS"
+`), 0644)
+
+	cli := New("test")
+	out := &bytes.Buffer{}
+	cli.SetStreams(IOStreams{In: os.Stdin, Out: out, Err: out})
+	cli.AddHandler("wait", func(ctx context.Context, options interface{}, streams IOStreams) error {
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	cli.AddPostRunHook("wait", func(ctx context.Context, command string, err error) error {
+		return fmt.Errorf("command hook failed")
+	})
+	cli.AddPostRunHook("", func(ctx context.Context, command string, err error) error {
+		fmt.Fprintf(out, "global post %v %v\n", err, ctx.Err())
+		return nil
+	})
+	err := RunCommand(cli, "wait")
+	if _, ok := err.(Interrupted); !ok {
+		t.Fatalf("Expected Interrupted, got %#v", err)
+	}
+	expected := "post wait 130\nglobal post interrupted by interrupt <nil>\n"
+	if out.String() != expected {
+		t.Errorf("Expected hooks output %q, got %q", expected, out.String())
+	}
+}
+
+// TestBareCli implements Interface without any of the optional interfaces
+// implemented by Cli.
+type TestBareCli struct {
+	options  interface{}
+	commands map[string]func() error
+}
+
+func (c *TestBareCli) Name() string                                 { return "test" }
+func (c *TestBareCli) GetDefaults() interface{}                     { return nil }
+func (c *TestBareCli) NewOptions() interface{}                      { return map[string]interface{}{} }
+func (c *TestBareCli) GetOptions() interface{}                      { return c.options }
+func (c *TestBareCli) SetOptions(options interface{})               { c.options = options }
+func (c *TestBareCli) CommandLine() *kingpin.Application            { return kingpin.New("test", "") }
+func (c *TestBareCli) SetCommands(commands map[string]func() error) { c.commands = commands }
+func (c *TestBareCli) GetCommand(command string) func() error       { return c.commands[command] }
+
+func TestBareInterface(t *testing.T) {
+	dir := t.TempDir()
+	os.Chdir(dir)
+	defer os.Chdir(testRoot)
+	os.Mkdir(".test.d", 0755)
+	ioutil.WriteFile(".test.d/config.yml", []byte(`
+project: ABC
+hooks:
+  pre-run:
+    - touch hooked
+`), 0644)
+
+	ran := false
+	cli := &TestBareCli{commands: map[string]func() error{"run": func() error {
+		ran = true
+		return nil
+	}}}
+	if err := processConfigsE(cli); err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]interface{}{"project": "ABC"}; !reflect.DeepEqual(cli.GetOptions(), expected) {
+		t.Errorf("Expected options %v, got %v", expected, cli.GetOptions())
+	}
+	if err := RunCommand(cli, "run"); err != nil || !ran {
+		t.Errorf("Expected run to run, got %v", err)
+	}
+	if _, err := os.Stat("hooked"); err != nil {
+		t.Errorf("Expected the config hook to run: %s", err)
+	}
+}
+
+func TestParseClibyTag(t *testing.T) {
+	field := reflect.StructField{Tag: `cliby:"help='Name, or id',short=p,required,merge=append"`}
+	expected := clibyTag{"help": "Name, or id", "short": "p", "required": "", "merge": "append"}
+	if got := parseClibyTag(field); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %#v but got %#v", expected, got)
+	}
+}
+
 func TestPromptWithDefault(t *testing.T) {
 	expectDefault := util.PromptWithDefault("foo", "bar")
 	if expectDefault != "bar" {
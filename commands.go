@@ -0,0 +1,244 @@
+package cliby
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/coryb/yaml.v2"
+)
+
+// Command is a node in the command tree built by BindCommands.  Name is the
+// full space separated command path, e.g. "issue create".  Options, when
+// set, must be a pointer to a struct; its fields are bound as flags of the
+// command and merged from the "commands" section of the configs:
+//
+//	commands:
+//	  issue:
+//	    project: GLOBAL
+//	    create:
+//	      type: Bug
+//
+// Sections of parent commands apply to their subcommands, and options not set
+// by any command section fall back to the global option with the same key.
+type Command struct {
+	Name string
+	// Aliases are alternative names for the last word of Name.
+	Aliases []string
+	Help    string
+	Options interface{}
+	Run     func() error
+	// Handler is used instead of Run when set.
+	Handler Handler
+	// PreRun and PostRun are added as hooks of the command, see
+	// AddPreRunHook.
+	PreRun  Hook
+	PostRun PostHook
+	Hidden  bool
+}
+
+// commandKey returns the config key path for the command options of name.
+func commandKey(name string) string {
+	return joinKey("commands", strings.Join(strings.Fields(name), "."))
+}
+
+// RegisterCommand adds cmd to the command tree and registers cmd.Run or
+// cmd.Handler so that RunCommand dispatches to it.  Parent commands do not
+// have to be registered first.
+func (c *Cli) RegisterCommand(cmd *Command) {
+	if c.tree == nil {
+		c.tree = make(map[string]*Command)
+	}
+	cmd.Name = strings.Join(strings.Fields(cmd.Name), " ")
+	c.tree[cmd.Name] = cmd
+	if cmd.Run != nil {
+		c.AddCommand(cmd.Name, cmd.Run)
+	}
+	if cmd.Handler != nil {
+		c.AddHandler(cmd.Name, cmd.Handler)
+	}
+	if cmd.PreRun != nil {
+		c.AddPreRunHook(cmd.Name, cmd.PreRun)
+	}
+	if cmd.PostRun != nil {
+		c.AddPostRunHook(cmd.Name, cmd.PostRun)
+	}
+	parent := strings.Fields(cmd.Name)
+	parent = parent[:len(parent)-1]
+	for _, alias := range cmd.Aliases {
+		c.AddCommandAlias(strings.Join(append(append([]string{}, parent...), alias), " "), cmd.Name)
+	}
+}
+
+func (c *Cli) GetRegisteredCommands() map[string]*Command {
+	return c.tree
+}
+
+// commandTree is implemented by Cli, other implementations of Interface have
+// no registered commands.
+type commandTree interface {
+	GetRegisteredCommands() map[string]*Command
+}
+
+func getRegisteredCommands(i Interface) map[string]*Command {
+	if tree, ok := i.(commandTree); ok {
+		return tree.GetRegisteredCommands()
+	}
+	return nil
+}
+
+// BindCommands adds the kingpin command hierarchy for the commands
+// registered on i to app, binding the flags of each command from its
+// Options.  Commands already defined on app are reused.
+func BindCommands(i Interface, app *kingpin.Application) error {
+	tree := getRegisteredCommands(i)
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cmd := tree[name]
+		kcmd := commandClause(app, name, cmd.Help)
+		if cmd.Hidden {
+			kcmd.Hidden()
+		}
+		for _, alias := range cmd.Aliases {
+			kcmd.Alias(alias)
+		}
+		if cmd.Options != nil {
+			if err := bindFlags(i, kcmd, commandKey(name), cmd.Options); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// commandClause returns the kingpin command for the space separated command
+// path name, adding it and any missing parent commands to app.
+func commandClause(app *kingpin.Application, name, help string) *kingpin.CmdClause {
+	parts := strings.Fields(name)
+	cmd := app.GetCommand(parts[0])
+	if cmd == nil {
+		if len(parts) > 1 {
+			cmd = app.Command(parts[0], "")
+		} else {
+			cmd = app.Command(parts[0], help)
+		}
+	}
+	for n := 1; n < len(parts); n++ {
+		sub := cmd.GetCommand(parts[n])
+		if sub == nil {
+			if n < len(parts)-1 {
+				sub = cmd.Command(parts[n], "")
+			} else {
+				sub = cmd.Command(parts[n], help)
+			}
+		}
+		cmd = sub
+	}
+	return cmd
+}
+
+// commandLayers returns the registered commands with options along the path
+// of command, starting with command itself.
+func commandLayers(i Interface, command string) []*Command {
+	layers := []*Command{}
+	parts := strings.Fields(command)
+	for n := len(parts); n > 0; n-- {
+		if cmd, ok := getRegisteredCommands(i)[strings.Join(parts[:n], " ")]; ok && cmd.Options != nil {
+			layers = append(layers, cmd)
+		}
+	}
+	return layers
+}
+
+// commandSection returns the config section for the command path parts from
+// the commands key of data.
+func commandSection(data map[string]interface{}, parts []string) map[string]interface{} {
+	section, _ := data["commands"].(map[string]interface{})
+	for _, part := range parts {
+		if section == nil {
+			return nil
+		}
+		section, _ = section[part].(map[string]interface{})
+	}
+	return section
+}
+
+// mergeCommandSections merges the command sections of a config into the
+// options of each command layer, the section of the command itself taking
+// precedence over the sections of its parents.
+func mergeCommandSections(data map[string]interface{}, source ConfigSource, record func(string, ConfigSource), state *mergeState) error {
+	if state == nil {
+		return nil
+	}
+	for _, cmd := range state.commands {
+		key := commandKey(cmd.Name)
+		parts := strings.Fields(cmd.Name)
+		for n := len(parts); n > 0; n-- {
+			section := commandSection(data, parts[:n])
+			if len(section) == 0 {
+				continue
+			}
+			content, err := yaml.Marshal(section)
+			if err != nil {
+				return err
+			}
+			nv := reflect.New(reflect.TypeOf(cmd.Options).Elem())
+			if err := yaml.Unmarshal(content, nv.Interface()); err != nil {
+				return err
+			}
+			m := &merger{source: source, record: record, state: state, present: presentKeys(key, section)}
+			m.mergeStructs(key, reflect.ValueOf(cmd.Options), nv)
+		}
+	}
+	return nil
+}
+
+// mergeGlobalOptions fills the options of each command layer from the global
+// options with the same keys, which is the lowest precedence source for
+// command options.
+func mergeGlobalOptions(iface Interface, state *mergeState) error {
+	if len(state.commands) == 0 {
+		return nil
+	}
+	content, err := yaml.Marshal(iface.GetOptions())
+	if err != nil {
+		return err
+	}
+	// empty global lists and maps are dropped so they do not replace nil
+	// command options
+	global := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &global); err != nil {
+		return err
+	}
+	for k, v := range global {
+		if rv := reflect.ValueOf(v); rv.IsValid() && (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Map) && rv.Len() == 0 {
+			delete(global, k)
+		}
+	}
+	if content, err = yaml.Marshal(global); err != nil {
+		return err
+	}
+	for _, cmd := range state.commands {
+		key := commandKey(cmd.Name)
+		nv := reflect.New(reflect.TypeOf(cmd.Options).Elem())
+		if err := yaml.Unmarshal(content, nv.Interface()); err != nil {
+			return err
+		}
+		m := &merger{
+			record: func(k string, _ ConfigSource) {
+				if source, ok := getSources(iface)[strings.TrimPrefix(k, key+".")]; ok {
+					setSource(iface, k, source)
+				}
+			},
+			state: state,
+		}
+		m.mergeStructs(key, reflect.ValueOf(cmd.Options), nv)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package cliby
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Completer returns the candidate values of a flag for shell completion,
+// e.g. project names fetched from an API.
+type Completer func() []string
+
+// AddCompleter registers fn to complete the values of the flag for the
+// option at key, e.g. "project" or "commands.issue.create.type" for a
+// command option.  Completers are used by flags bound with BindFlags and
+// BindCommands.
+func (c *Cli) AddCompleter(key string, fn Completer) {
+	if c.completers == nil {
+		c.completers = make(map[string]Completer)
+	}
+	c.completers[key] = fn
+}
+
+func (c *Cli) GetCompleter(key string) Completer {
+	return c.completers[key]
+}
+
+// completerRegistry is implemented by Cli, other implementations of
+// Interface have no completers.
+type completerRegistry interface {
+	GetCompleter(string) Completer
+}
+
+func getCompleter(i Interface, key string) Completer {
+	if registry, ok := i.(completerRegistry); ok {
+		return registry.GetCompleter(key)
+	}
+	return nil
+}
+
+// isCompletion reports whether args ask kingpin for completions.
+func isCompletion(args []string) bool {
+	return len(args) > 0 && args[0] == "--completion-bash"
+}
+
+// bindAliasCommands adds a kingpin command for every config alias so that
+// aliases are completed along with the real commands.
+func bindAliasCommands(i Interface, app *kingpin.Application) {
+	for alias, words := range loadConfigAliases(i) {
+		if app.GetCommand(alias) == nil {
+			app.Command(alias, fmt.Sprintf("Alias for %s", strings.Join(words, " "))).Arg("args", "").Strings()
+		}
+	}
+}
+
+var completionScripts = map[string]string{
+	"bash": `# bash completion for {{.Name}}, load with:
+#   source <({{.Name}} completion bash)
+_{{.Func}}_complete() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local opts
+    opts=$("${COMP_WORDS[0]}" --completion-bash ${COMP_WORDS[@]:1:$COMP_CWORD})
+    COMPREPLY=( $(compgen -W "${opts}" -- "${cur}") )
+    return 0
+}
+complete -o default -F _{{.Func}}_complete {{.Name}}
+`,
+	"zsh": `#compdef {{.Name}}
+# zsh completion for {{.Name}}, load with:
+#   source <({{.Name}} completion zsh)
+_{{.Func}}_complete() {
+    local -a opts
+    opts=("${(@f)$("${words[1]}" --completion-bash ${words[2,CURRENT]})}")
+    compadd -- "${opts[@]}"
+}
+compdef _{{.Func}}_complete {{.Name}}
+`,
+	"fish": `# fish completion for {{.Name}}, load with:
+#   {{.Name}} completion fish | source
+function __{{.Func}}_complete
+    set -l tokens (commandline -opc) (commandline -ct)
+    set -e tokens[1]
+    command {{.Name}} --completion-bash (string match -v -- '' $tokens)
+end
+complete -c {{.Name}} -f -a '(__{{.Func}}_complete)'
+`,
+}
+
+var nonIdentifier = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// WriteCompletion writes the completion script for shell (bash, zsh or
+// fish) to out.  The scripts ask the program for completions with kingpin's
+// --completion-bash flag, so they include custom commands, config aliases
+// and the values returned by completers registered with AddCompleter.
+func WriteCompletion(i Interface, shell string, out io.Writer) error {
+	script, ok := completionScripts[shell]
+	if !ok {
+		return fmt.Errorf("Unknown shell %q, expected bash, zsh or fish", shell)
+	}
+	tmpl := template.Must(template.New(shell).Parse(script))
+	return tmpl.Execute(out, map[string]string{
+		"Name": i.Name(),
+		"Func": nonIdentifier.ReplaceAllString(i.Name(), "_"),
+	})
+}
+
+// AddCompletionCommand registers the built-in "completion bash|zsh|fish"
+// commands on app.  Like AddConfigCommand it is opt-in, call it from
+// CommandLine().
+func AddCompletionCommand(i Interface, app *kingpin.Application) {
+	cmd := app.Command("completion", "Print a shell completion script")
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		shell := shell
+		cmd.Command(shell, fmt.Sprintf("Print the %s completion script", shell))
+		addHandler(i, "completion "+shell, func(ctx context.Context, options interface{}, streams IOStreams) error {
+			return WriteCompletion(i, shell, streams.Out)
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package cliby
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/coryb/yaml.v2"
+)
+
+// AddConfigCommand registers the built-in "config show" and "config explain"
+// commands on app and in the command map of i.  It is opt-in, call it from
+// CommandLine() after the application is created.  The commands write to the
+// Out stream of i.
+func AddConfigCommand(i Interface, app *kingpin.Application) {
+	format := "yaml"
+	cmd := app.Command("config", "Inspect the effective configuration")
+
+	show := cmd.Command("show", "Print the merged options")
+	show.Flag("format", "Output format: yaml or json").Default("yaml").EnumVar(&format, "yaml", "json")
+	addCommand(i, "config show", func() error {
+		return ShowConfig(i, format, getStreams(i).Out)
+	})
+
+	explain := cmd.Command("explain", "Print the merged options with the source of each value and the config files searched")
+	explain.Flag("format", "Output format: yaml or json").Default("yaml").EnumVar(&format, "yaml", "json")
+	addCommand(i, "config explain", func() error {
+		return ExplainConfig(i, format, getStreams(i).Out)
+	})
+}
+
+func ShowConfig(i Interface, format string, out io.Writer) error {
+	return writeConfig(i.GetOptions(), format, out)
+}
+
+type configPath struct {
+	Path   string `json:"path" yaml:"path"`
+	Exists bool   `json:"exists" yaml:"exists"`
+}
+
+type configValue struct {
+	Key    string      `json:"key" yaml:"key"`
+	Value  interface{} `json:"value" yaml:"value"`
+	Source string      `json:"source,omitempty" yaml:"source,omitempty"`
+}
+
+type configExplanation struct {
+	Searched []configPath  `json:"searched" yaml:"searched"`
+	Options  []configValue `json:"options" yaml:"options"`
+}
+
+func ExplainConfig(i Interface, format string, out io.Writer) error {
+	explanation := configExplanation{
+		Searched: []configPath{},
+		Options:  []configValue{},
+	}
+	for _, path := range getConfigPaths(i) {
+		_, err := os.Stat(path)
+		explanation.Searched = append(explanation.Searched, configPath{Path: path, Exists: err == nil})
+	}
+	sources := getSources(i)
+	flattenOptions("", reflect.ValueOf(i.GetOptions()), func(key string, value interface{}) {
+		cv := configValue{Key: key, Value: value}
+		if source, ok := lookupSource(sources, key); ok {
+			cv.Source = source.String()
+		}
+		explanation.Options = append(explanation.Options, cv)
+	})
+	return writeConfig(explanation, format, out)
+}
+
+func writeConfig(data interface{}, format string, out io.Writer) error {
+	var content []byte
+	var err error
+	switch format {
+	case "json":
+		content, err = json.MarshalIndent(data, "", "    ")
+		content = append(content, '\n')
+	case "yaml", "":
+		content, err = yaml.Marshal(data)
+	default:
+		err = fmt.Errorf("Unknown config format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(content)
+	return err
+}
+
+// flattenOptions calls fn with the key path and value of every leaf value in
+// v, using the same key paths recorded by the merger.
+func flattenOptions(key string, v reflect.Value, fn func(string, interface{})) {
+	v = reflect.Indirect(v)
+	for v.Kind() == reflect.Interface {
+		v = reflect.Indirect(v.Elem())
+	}
+	if !v.IsValid() {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			flattenOptions(joinKey(key, fieldKey(v.Type().Field(i))), v.Field(i), fn)
+		}
+	case reflect.Map:
+		keys := make([]string, 0, v.Len())
+		values := make(map[string]reflect.Value)
+		for _, k := range v.MapKeys() {
+			name := fmt.Sprint(k.Interface())
+			keys = append(keys, name)
+			values[name] = v.MapIndex(k)
+		}
+		sort.Strings(keys)
+		for _, name := range keys {
+			flattenOptions(joinKey(key, name), values[name], fn)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			flattenOptions(indexKey(key, i), v.Index(i), fn)
+		}
+	default:
+		fn(key, v.Interface())
+	}
+}
@@ -0,0 +1,228 @@
+package cliby
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// configCache holds what the configs contained when they were last read.
+// The config-only keys of the configs are needed before the command line is
+// parsed, so the configs are read then, and their content is kept until
+// loadConfigs merges them, so that executable configs only run once.  The
+// config-only keys of the configs loadConfigs merged are kept for the
+// handlers.
+type configCache struct {
+	mu       sync.Mutex
+	contents map[string]*configContent
+	configs  []rawConfig
+	loaded   bool
+}
+
+// configContent is the content of a config file, or the output of an
+// executable config, and the format to decode it with.
+type configContent struct {
+	source  ConfigSource
+	ext     string
+	content []byte
+}
+
+// rawConfig holds the config-only keys of a config, after its "key!"
+// directives were extracted into finals.
+type rawConfig struct {
+	file   string
+	data   map[string]interface{}
+	finals []string
+}
+
+// configSection is the value of a config-only key in one config.
+type configSection struct {
+	file string
+	data interface{}
+}
+
+// configCacher is implemented by Cli, other implementations of Interface
+// read the configs every time.
+type configCacher interface {
+	cachedConfigs() *configCache
+}
+
+func (c *Cli) cachedConfigs() *configCache {
+	return c.configs
+}
+
+func getConfigCache(i Interface) *configCache {
+	if cacher, ok := i.(configCacher); ok {
+		return cacher.cachedConfigs()
+	}
+	return nil
+}
+
+// reset forgets the configs, so that they are read again.
+func (cache *configCache) reset() {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.contents = nil
+	cache.configs, cache.loaded = nil, false
+}
+
+// read returns the content of file, running it when it is executable.  It
+// returns nil without an error when file cannot be read.
+func (cache *configCache) read(file string) (*configContent, error) {
+	if cache != nil {
+		cache.mu.Lock()
+		config, ok := cache.contents[file]
+		cache.mu.Unlock()
+		if ok {
+			return config, nil
+		}
+	}
+	stat, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &configContent{source: ConfigSource{Kind: SourceFile, File: file}, ext: configExt(file)}
+	// check to see if config file is exectuable
+	if stat.Mode()&0111 == 0 {
+		log.Debugf("Loading config %s", file)
+		if config.content, err = ioutil.ReadFile(file); err != nil {
+			log.Debugf("Failed to read %s: %s", file, err)
+			return nil, nil
+		}
+	} else {
+		log.Debugf("Found Executable Config file: %s", file)
+		config.source.Kind = SourceExec
+		// it is executable, so run it and try to parse the output
+		cmd := exec.Command(file)
+		stdout := bytes.NewBufferString("")
+		stderr := bytes.NewBufferString("")
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			return nil, newConfigExecError(file, stderr.String(), err)
+		}
+		config.ext, config.content = execOutputFormat(file, stdout.Bytes())
+	}
+	if cache != nil {
+		cache.mu.Lock()
+		if cache.contents == nil {
+			cache.contents = make(map[string]*configContent)
+		}
+		cache.contents[file] = config
+		cache.mu.Unlock()
+	}
+	return config, nil
+}
+
+// setConfigs replaces the config-only keys with those of the configs
+// loadConfigs merged, and forgets their content.
+func (cache *configCache) setConfigs(configs []rawConfig) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.contents = nil
+	cache.configs, cache.loaded = configs, true
+}
+
+// newRawConfig returns the config-only keys of data, and the finals below
+// them.
+func newRawConfig(file string, data map[string]interface{}, finals []string) rawConfig {
+	config := rawConfig{file: file, data: make(map[string]interface{})}
+	for _, key := range configOnlyKeys {
+		if value, ok := data[key]; ok {
+			config.data[key] = value
+		}
+	}
+	for _, final := range finals {
+		if isConfigOnlyKey(strings.SplitN(final, ".", 2)[0]) {
+			config.finals = append(config.finals, final)
+		}
+	}
+	return config
+}
+
+// loadedConfigs returns the config-only keys of the configs loaded by the
+// last ProcessAllOptions or LoadConfigs, reading the configs when they were
+// not loaded yet, e.g. while the command line is parsed.
+func loadedConfigs(i Interface) []rawConfig {
+	cache := getConfigCache(i)
+	if cache != nil {
+		cache.mu.Lock()
+		configs, loaded := cache.configs, cache.loaded
+		cache.mu.Unlock()
+		if loaded {
+			return configs
+		}
+	}
+	state := &mergeState{scan: true}
+	paths := configPaths(i, configFileName(i, i.GetOptions(), i.GetDefaults()))
+	for n := len(paths) - 1; n >= 0; n-- {
+		if stat, err := os.Stat(paths[n]); err == nil && !stat.IsDir() {
+			if err := loadConfig(i, paths[n], nil, state); err != nil {
+				log.Debugf("Skipping %s: %s", paths[n], err)
+			}
+		}
+	}
+	if cache != nil {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		if !cache.loaded {
+			cache.configs, cache.loaded = state.configs, true
+		}
+		return cache.configs
+	}
+	return state.configs
+}
+
+// configSections returns the value of the config-only key name in every
+// config that has it, closest first.  Like for options, "name!" in a config
+// hides name in the configs further away, and "name.key!" hides key.
+func configSections(i Interface, name string) []configSection {
+	sections := []configSection{}
+	finals := make(map[string]bool)
+	for _, config := range loadedConfigs(i) {
+		if data, ok := config.data[name]; ok && data != nil {
+			sections = append(sections, configSection{file: config.file, data: withoutFinals(name, data, finals)})
+		}
+		for _, final := range config.finals {
+			finals[final] = true
+		}
+		if finals[name] {
+			break
+		}
+	}
+	return sections
+}
+
+// withoutFinals returns a copy of the value at key without the map keys
+// below it that are in finals.
+func withoutFinals(key string, value interface{}, finals map[string]bool) interface{} {
+	data, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	copied := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		if !finals[joinKey(key, k)] {
+			copied[k] = withoutFinals(joinKey(key, k), v, finals)
+		}
+	}
+	return copied
+}
+
+func isConfigOnlyKey(key string) bool {
+	for _, k := range configOnlyKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
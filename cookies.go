@@ -0,0 +1,304 @@
+package cliby
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+	"gopkg.in/coryb/cliby.v1/util"
+)
+
+// DefaultSessionTTL is how long cookies without an expiry, which a browser
+// would drop when it exits, are kept in the cookie file.
+var DefaultSessionTTL = 7 * 24 * time.Hour
+
+// CookieJar is an http.CookieJar persisting cookies to File, so that
+// sessions survive between invocations.  Cookies are matched to requests by
+// net/http/cookiejar, and expire when the server says so, or after
+// SessionTTL for session cookies.  Every change is written to File right
+// away, merged with the changes of other processes under a lock file.
+type CookieJar struct {
+	File       string
+	SessionTTL time.Duration
+
+	mu      sync.Mutex
+	jar     *cookiejar.Jar
+	changes map[string]*storedCookie
+}
+
+// storedCookie is a cookie as saved in the cookie file.  HostOnly cookies
+// are only sent to Domain, otherwise they are also sent to its subdomains.
+type storedCookie struct {
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Domain   string    `json:"domain"`
+	Path     string    `json:"path"`
+	Expires  time.Time `json:"expires"`
+	Secure   bool      `json:"secure"`
+	HttpOnly bool      `json:"http-only"`
+	HostOnly bool      `json:"host-only"`
+}
+
+func (s *storedCookie) key() string {
+	return s.Domain + ";" + s.Path + ";" + s.Name
+}
+
+func NewCookieJar(file string) *CookieJar {
+	return &CookieJar{File: file, SessionTTL: DefaultSessionTTL}
+}
+
+// load fills the in-memory jar from File the first time it is used.
+func (j *CookieJar) load() {
+	if j.jar != nil {
+		return
+	}
+	j.jar, _ = cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	j.changes = make(map[string]*storedCookie)
+	stored, err := readCookies(j.File)
+	if err != nil {
+		log.Errorf("Failed to load cookies from %s: %s", j.File, err)
+	}
+	now := time.Now()
+	for _, s := range stored {
+		if !s.Expires.After(now) {
+			continue
+		}
+		u := &url.URL{Scheme: "http", Host: s.Domain, Path: s.Path}
+		if s.Secure {
+			u.Scheme = "https"
+		}
+		cookie := &http.Cookie{Name: s.Name, Value: s.Value, Path: s.Path, Expires: s.Expires, Secure: s.Secure, HttpOnly: s.HttpOnly}
+		if !s.HostOnly {
+			cookie.Domain = s.Domain
+		}
+		j.jar.SetCookies(u, []*http.Cookie{cookie})
+	}
+}
+
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.load()
+	return j.jar.Cookies(u)
+}
+
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.load()
+	j.jar.SetCookies(u, cookies)
+
+	now := time.Now()
+	changed := false
+	for _, cookie := range cookies {
+		stored := j.storedCookie(u, cookie, now)
+		if stored == nil {
+			continue
+		}
+		if !stored.Expires.After(now) {
+			// a nil change removes the cookie from the file
+			j.changes[stored.key()] = nil
+		} else {
+			j.changes[stored.key()] = stored
+		}
+		changed = true
+	}
+	if changed && j.File != "" {
+		if err := j.save(); err != nil {
+			log.Errorf("Failed to save cookies to %s: %s", j.File, err)
+		}
+	}
+}
+
+// storedCookie returns cookie as set by a response from u, or nil when the
+// jar rejects it because its Domain does not match u, or is a public suffix
+// like co.uk.
+func (j *CookieJar) storedCookie(u *url.URL, cookie *http.Cookie, now time.Time) *storedCookie {
+	host := strings.ToLower(u.Hostname())
+	stored := &storedCookie{
+		Name:     cookie.Name,
+		Value:    cookie.Value,
+		Domain:   strings.TrimPrefix(strings.ToLower(cookie.Domain), "."),
+		Path:     cookie.Path,
+		Secure:   cookie.Secure,
+		HttpOnly: cookie.HttpOnly,
+	}
+	if stored.Domain == "" {
+		stored.Domain, stored.HostOnly = host, true
+	} else if stored.Domain != host && (net.ParseIP(host) != nil || !strings.HasSuffix(host, "."+stored.Domain) || publicsuffix.List.PublicSuffix(stored.Domain) == stored.Domain) {
+		return nil
+	}
+	if !strings.HasPrefix(stored.Path, "/") {
+		stored.Path = defaultCookiePath(u.Path)
+	}
+	switch {
+	case cookie.MaxAge < 0:
+		stored.Expires = now
+	case cookie.MaxAge > 0:
+		stored.Expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+	case !cookie.Expires.IsZero():
+		stored.Expires = cookie.Expires
+	default:
+		stored.Expires = now.Add(j.SessionTTL)
+	}
+	return stored
+}
+
+// defaultCookiePath is the path of a cookie without a Path attribute, the
+// directory of the request path (RFC 6265 section 5.1.4).
+func defaultCookiePath(path string) string {
+	if n := strings.LastIndex(path, "/"); n > 0 {
+		return path[:n]
+	}
+	return "/"
+}
+
+// save merges the changes of this jar into File, keeping the cookies other
+// processes saved since it was loaded.
+func (j *CookieJar) save() error {
+	if err := util.Mkdir(filepath.Dir(j.File)); err != nil {
+		return err
+	}
+	unlock, err := lockFile(j.File + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	stored, err := readCookies(j.File)
+	if err != nil {
+		return err
+	}
+	merged := make(map[string]*storedCookie)
+	for _, s := range stored {
+		merged[s.key()] = s
+	}
+	for key, s := range j.changes {
+		merged[key] = s
+	}
+	now := time.Now()
+	cookies := make([]*storedCookie, 0, len(merged))
+	for _, s := range merged {
+		if s != nil && s.Expires.After(now) {
+			cookies = append(cookies, s)
+		}
+	}
+	log.Debugf("Saving %d cookies to %s", len(cookies), j.File)
+	return writeCookies(j.File, cookies)
+}
+
+func readCookies(file string) ([]*storedCookie, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	cookies := []*storedCookie{}
+	if err := json.Unmarshal(content, &cookies); err != nil {
+		return nil, fmt.Errorf("Failed to parse json from file %s: %s", file, err)
+	}
+	return cookies, nil
+}
+
+func writeCookies(file string, cookies []*storedCookie) error {
+	content, err := json.Marshal(cookies)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, content)
+}
+
+// writeFileAtomic replaces file by renaming a temporary file, only readable
+// by the user, over it so readers never see a partially written file.
+func writeFileAtomic(file string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+var lockTimeout = 5 * time.Second
+
+// lockFile takes an exclusive lock on the lock file at path, waiting for
+// other processes to release it first.  The lock is held on the open file
+// rather than by the file existing, so it is released when a process dies
+// holding it, and the file is left in place.
+func lockFile(path string) (unlock func(), err error) {
+	fh, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		locked, err := tryLockFile(fh)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+		if locked {
+			return func() {
+				unlockFile(fh)
+				fh.Close()
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			fh.Close()
+			return nil, fmt.Errorf("Timed out waiting for lock file %s", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// SetCookieFile sets the file cookies are saved to, ~/.<name>.d/cookies.js
+// by default.  An empty file keeps cookies in memory only.
+func (c *Cli) SetCookieFile(file string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cookieFile = file
+	if c.ua != nil && c.ua.Jar == c.jar {
+		c.ua.Jar = nil
+	}
+	c.jar = nil
+}
+
+func (c *Cli) GetCookieFile() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cookieFile
+}
+
+// initCookies gives the HTTP client the persistent cookie jar, unless it
+// already has a jar.
+func (c *Cli) initCookies() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	client := c.httpClient()
+	if client.Jar != nil {
+		return
+	}
+	if c.jar == nil {
+		c.jar = NewCookieJar(c.cookieFile)
+	}
+	client.Jar = c.jar
+}
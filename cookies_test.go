@@ -0,0 +1,111 @@
+package cliby
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCookieJar(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+			http.SetCookie(w, &http.Cookie{Name: "token", Value: "xyz", MaxAge: 3600})
+			http.SetCookie(w, &http.Cookie{Name: "expired", Value: "1", Expires: time.Now().Add(-time.Hour)})
+			http.SetCookie(w, &http.Cookie{Name: "scoped", Value: "1", Path: "/api"})
+			http.SetCookie(w, &http.Cookie{Name: "foreign", Value: "1", Domain: "example.com"})
+		case "/logout":
+			http.SetCookie(w, &http.Cookie{Name: "session", MaxAge: -1})
+		}
+		names := []string{}
+		for _, cookie := range r.Cookies() {
+			names = append(names, cookie.Name)
+		}
+		sort.Strings(names)
+		fmt.Fprint(w, strings.Join(names, ","))
+	}))
+	defer server.Close()
+
+	file := filepath.Join(testDir(t, ""), ".test.d/cookies.js")
+	get := func(cli *Cli, path string) string {
+		t.Helper()
+		resp, err := cli.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	newCli := func() *Cli {
+		cli := New("test")
+		cli.SetCookieFile(file)
+		return cli
+	}
+
+	get(newCli(), "/login")
+	if cookies := get(newCli(), "/"); cookies != "session,token" {
+		t.Errorf("Expected saved cookies session,token, got %q", cookies)
+	}
+	if cookies := get(newCli(), "/api/issues"); cookies != "scoped,session,token" {
+		t.Errorf("Expected saved cookies scoped,session,token, got %q", cookies)
+	}
+
+	// a jar loaded before another process logged out keeps the logout
+	stale := newCli()
+	get(stale, "/")
+	get(newCli(), "/logout")
+	stale.GetHttpClient().Jar.SetCookies(&url.URL{Scheme: "http", Host: "other.example.com", Path: "/"}, []*http.Cookie{{Name: "other", Value: "1"}})
+	if cookies := get(newCli(), "/"); cookies != "token" {
+		t.Errorf("Expected session cookie to be removed, got %q", cookies)
+	}
+	content, _ := ioutil.ReadFile(file)
+	if !strings.Contains(string(content), `"domain":"other.example.com"`) {
+		t.Errorf("Expected cookie for other.example.com to be saved, got %s", content)
+	}
+
+	stored := []*storedCookie{}
+	json.Unmarshal(content, &stored)
+	for _, s := range stored {
+		s.Expires = time.Now().Add(-time.Minute)
+	}
+	writeCookies(file, stored)
+	if cookies := get(newCli(), "/"); cookies != "" {
+		t.Errorf("Expected expired cookies not to be sent, got %q", cookies)
+	}
+
+	// a cookie for a public suffix would be sent to every site below it
+	jar := NewCookieJar("")
+	jar.SetCookies(&url.URL{Scheme: "https", Host: "a.example.co.uk", Path: "/"}, []*http.Cookie{{Name: "shared", Value: "1", Domain: "co.uk"}})
+	if cookies := jar.Cookies(&url.URL{Scheme: "https", Host: "other.co.uk", Path: "/"}); len(cookies) != 0 {
+		t.Errorf("Expected cookie for co.uk to be rejected, got %v", cookies)
+	}
+
+	defer func(timeout time.Duration) { lockTimeout = timeout }(lockTimeout)
+	lockTimeout = 50 * time.Millisecond
+	unlock, err := lockFile(file + ".lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockFile(file + ".lock"); err == nil {
+		t.Errorf("Expected the lock to be held")
+	}
+	unlock()
+
+	// a lock file left behind by a process that died holding it is not
+	// locked
+	ioutil.WriteFile(file+".lock", nil, 0600)
+	get(newCli(), "/login")
+	if cookies := get(newCli(), "/"); cookies != "session,token" {
+		t.Errorf("Expected stale lock to be ignored, got %q", cookies)
+	}
+}
@@ -0,0 +1,378 @@
+package cliby
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+	"gopkg.in/coryb/cliby.v1/util"
+	"gopkg.in/coryb/yaml.v2"
+)
+
+// Credential is a secret for a host, with the attributes of the git
+// credential helper protocol.
+type Credential struct {
+	Protocol          string `json:"protocol,omitempty"`
+	Host              string `json:"host"`
+	Path              string `json:"path,omitempty"`
+	Username          string `json:"username,omitempty"`
+	Password          string `json:"password,omitempty"`
+	OAuthRefreshToken string `json:"oauth-refresh-token,omitempty"`
+}
+
+// matches reports whether c has every attribute set in query.
+func (c Credential) matches(query Credential) bool {
+	return (query.Protocol == "" || query.Protocol == c.Protocol) &&
+		(query.Host == "" || query.Host == c.Host) &&
+		(query.Path == "" || query.Path == c.Path) &&
+		(query.Username == "" || query.Username == c.Username)
+}
+
+// CredentialStore keeps secrets out of config files, auth providers from the
+// "auth" section of the configs read the secrets missing from their config
+// from it.
+type CredentialStore interface {
+	// Get returns the credential matching the attributes set in query, or a
+	// CredentialNotFoundError.
+	Get(query Credential) (Credential, error)
+	// Store adds cred, replacing the credential with the same protocol, host,
+	// path and username.
+	Store(cred Credential) error
+	// Erase removes the credentials matching the attributes set in query.
+	Erase(query Credential) error
+}
+
+// FileCredentialStore keeps credentials as JSON in File, encrypted with
+// AES-GCM when Passphrase is set, using a key derived from the passphrase
+// with PBKDF2.
+type FileCredentialStore struct {
+	File       string
+	Passphrase func() (string, error)
+}
+
+func NewFileCredentialStore(file string) *FileCredentialStore {
+	return &FileCredentialStore{File: file}
+}
+
+func NewEncryptedCredentialStore(file string, passphrase func() (string, error)) *FileCredentialStore {
+	return &FileCredentialStore{File: file, Passphrase: passphrase}
+}
+
+func (s *FileCredentialStore) Get(query Credential) (Credential, error) {
+	creds, err := s.read()
+	if err != nil {
+		return Credential{}, err
+	}
+	for _, cred := range creds {
+		if cred.matches(query) {
+			return cred, nil
+		}
+	}
+	return Credential{}, CredentialNotFoundError{Host: query.Host, Username: query.Username}
+}
+
+func (s *FileCredentialStore) Store(cred Credential) error {
+	return s.update(func(creds []Credential) []Credential {
+		for n, existing := range creds {
+			if existing.Protocol == cred.Protocol && existing.Host == cred.Host && existing.Path == cred.Path && existing.Username == cred.Username {
+				creds[n] = cred
+				return creds
+			}
+		}
+		return append(creds, cred)
+	})
+}
+
+func (s *FileCredentialStore) Erase(query Credential) error {
+	return s.update(func(creds []Credential) []Credential {
+		kept := []Credential{}
+		for _, cred := range creds {
+			if !cred.matches(query) {
+				kept = append(kept, cred)
+			}
+		}
+		return kept
+	})
+}
+
+// update rewrites File with the credentials returned by change, holding the
+// lock file so concurrent updates are not lost.
+func (s *FileCredentialStore) update(change func([]Credential) []Credential) error {
+	if err := util.Mkdir(filepath.Dir(s.File)); err != nil {
+		return err
+	}
+	unlock, err := lockFile(s.File + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	creds, err := s.read()
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(change(creds))
+	if err != nil {
+		return err
+	}
+	if s.Passphrase != nil {
+		if content, err = s.encrypt(content); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(s.File, content)
+}
+
+func (s *FileCredentialStore) read() ([]Credential, error) {
+	content, err := ioutil.ReadFile(s.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if s.Passphrase != nil {
+		if content, err = s.decrypt(content); err != nil {
+			return nil, err
+		}
+	}
+	creds := []Credential{}
+	if err := json.Unmarshal(content, &creds); err != nil {
+		return nil, fmt.Errorf("Failed to parse json from file %s: %s", s.File, err)
+	}
+	return creds, nil
+}
+
+// encryptedCredentials is the content of an encrypted credentials file.
+type encryptedCredentials struct {
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Data       []byte `json:"data"`
+}
+
+var pbkdf2Iterations = 100000
+
+func (s *FileCredentialStore) cipher(salt []byte, iterations int) (cipher.AEAD, error) {
+	passphrase, err := s.Passphrase()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(credentialKey(passphrase, salt, iterations))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *FileCredentialStore) encrypt(content []byte) ([]byte, error) {
+	encrypted := encryptedCredentials{Iterations: pbkdf2Iterations, Salt: make([]byte, 16)}
+	if _, err := rand.Read(encrypted.Salt); err != nil {
+		return nil, err
+	}
+	gcm, err := s.cipher(encrypted.Salt, encrypted.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	encrypted.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(encrypted.Nonce); err != nil {
+		return nil, err
+	}
+	encrypted.Data = gcm.Seal(nil, encrypted.Nonce, content, nil)
+	return json.Marshal(encrypted)
+}
+
+func (s *FileCredentialStore) decrypt(content []byte) ([]byte, error) {
+	encrypted := encryptedCredentials{}
+	if err := json.Unmarshal(content, &encrypted); err != nil {
+		return nil, fmt.Errorf("Failed to parse json from file %s: %s", s.File, err)
+	}
+	gcm, err := s.cipher(encrypted.Salt, encrypted.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("Invalid nonce in %s", s.File)
+	}
+	decrypted, err := gcm.Open(nil, encrypted.Nonce, encrypted.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt %s, wrong passphrase?", s.File)
+	}
+	return decrypted, nil
+}
+
+// credentialKey derives the AES-256 key of an encrypted file from passphrase
+// with PBKDF2 using HMAC-SHA256.
+func credentialKey(passphrase string, salt []byte, iterations int) []byte {
+	return pbkdf2.Key([]byte(passphrase), salt, iterations, 32, sha256.New)
+}
+
+// HelperCredentialStore runs Command with "get", "store" or "erase" as its
+// last argument, exchanging credentials as key=value lines over stdin and
+// stdout like git credential helpers, e.g. "git credential-osxkeychain".
+type HelperCredentialStore struct {
+	Command string
+}
+
+func (s *HelperCredentialStore) Get(query Credential) (Credential, error) {
+	cred, err := s.run("get", query)
+	if err != nil {
+		return Credential{}, err
+	}
+	if cred.Password == "" && cred.OAuthRefreshToken == "" {
+		return Credential{}, CredentialNotFoundError{Host: query.Host, Username: query.Username}
+	}
+	return cred, nil
+}
+
+func (s *HelperCredentialStore) Store(cred Credential) error {
+	_, err := s.run("store", cred)
+	return err
+}
+
+func (s *HelperCredentialStore) Erase(query Credential) error {
+	_, err := s.run("erase", query)
+	return err
+}
+
+var credentialAttributes = []string{"protocol", "host", "path", "username", "password", "oauth_refresh_token"}
+
+func (c *Credential) attribute(name string) *string {
+	switch name {
+	case "protocol":
+		return &c.Protocol
+	case "host":
+		return &c.Host
+	case "path":
+		return &c.Path
+	case "username":
+		return &c.Username
+	case "password":
+		return &c.Password
+	case "oauth_refresh_token":
+		return &c.OAuthRefreshToken
+	}
+	return nil
+}
+
+func (s *HelperCredentialStore) run(operation string, cred Credential) (Credential, error) {
+	input := &bytes.Buffer{}
+	for _, name := range credentialAttributes {
+		value := *cred.attribute(name)
+		if strings.ContainsAny(value, "\n\x00") {
+			// the helper would read the rest of the line as another attribute
+			return cred, fmt.Errorf("Invalid %s for credential helper, it contains a newline or NUL", name)
+		}
+		if value != "" {
+			fmt.Fprintf(input, "%s=%s\n", name, value)
+		}
+	}
+	input.WriteString("\n")
+
+	output := &bytes.Buffer{}
+	cmd := exec.Command("sh", "-c", s.Command+" "+operation)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = input, output, os.Stderr
+	log.Debugf("Running credential helper: %s %s", s.Command, operation)
+	if err := cmd.Run(); err != nil {
+		return cred, fmt.Errorf("Credential helper %q failed: %s", s.Command, err)
+	}
+
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if value := cred.attribute(parts[0]); value != nil {
+			*value = parts[1]
+		}
+	}
+	return cred, nil
+}
+
+// CredentialStoreConfig is the "credential-store" section of a config file,
+// selecting where secrets are kept:
+//
+//	credential-store:
+//	  type: helper
+//	  helper: git credential-osxkeychain
+//
+// Type is file (the default), encrypted or helper.  File defaults to
+// ~/.<name>.d/credentials.json, or credentials.enc when encrypted, and the
+// passphrase of an encrypted file is read from <NAME>_CREDENTIAL_PASSPHRASE.
+type CredentialStoreConfig struct {
+	Type   string `json:"type" yaml:"type"`
+	File   string `json:"file" yaml:"file"`
+	Helper string `json:"helper" yaml:"helper"`
+}
+
+func (c *Cli) SetCredentialStore(store CredentialStore) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.credentials = store
+}
+
+// GetCredentialStore returns the store set with SetCredentialStore, or the
+// store selected by the "credential-store" section of the closest config.
+func (c *Cli) GetCredentialStore() CredentialStore {
+	c.mu.Lock()
+	store := c.credentials
+	c.mu.Unlock()
+	if store != nil {
+		return store
+	}
+	store = loadConfigCredentialStore(c)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.credentials == nil {
+		c.credentials = store
+	}
+	return c.credentials
+}
+
+func loadConfigCredentialStore(i Interface) CredentialStore {
+	config := CredentialStoreConfig{}
+	if sections := configSections(i, "credential-store"); len(sections) > 0 {
+		content, err := yaml.Marshal(sections[0].data)
+		if err == nil {
+			err = yaml.Unmarshal(content, &config)
+		}
+		if err != nil {
+			log.Errorf("Invalid credential-store in %s: %s", sections[0].file, err)
+		}
+	}
+
+	dir := fmt.Sprintf("%s/.%s.d", os.Getenv("HOME"), i.Name())
+	switch config.Type {
+	case "helper":
+		return &HelperCredentialStore{Command: config.Helper}
+	case "encrypted":
+		if config.File == "" {
+			config.File = filepath.Join(dir, "credentials.enc")
+		}
+		env := fmt.Sprintf("%s_CREDENTIAL_PASSPHRASE", strings.ToUpper(i.Name()))
+		return NewEncryptedCredentialStore(config.File, func() (string, error) {
+			if passphrase := os.Getenv(env); passphrase != "" {
+				return passphrase, nil
+			}
+			return "", fmt.Errorf("%s must be set to use the encrypted credential store", env)
+		})
+	case "", "file":
+	default:
+		log.Errorf("Unknown credential-store type %q, expected file, encrypted or helper", config.Type)
+	}
+	if config.File == "" {
+		config.File = filepath.Join(dir, "credentials.json")
+	}
+	return NewFileCredentialStore(config.File)
+}
@@ -0,0 +1,168 @@
+package cliby
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestCredentialStores(t *testing.T) {
+	// RFC 6070 test vectors for PBKDF2 with HMAC-SHA1
+	for _, test := range []struct {
+		password, salt string
+		iterations     int
+		key            string
+	}{
+		{"password", "salt", 1, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"password", "salt", 2, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{"password", "salt", 4096, "4b007901b765489abead49d926f721d065a429c1"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"},
+		{"pass\x00word", "sa\x00lt", 4096, "56fa6aa75548099dcc37d7f03425e0c3"},
+	} {
+		if key := fmt.Sprintf("%x", pbkdf2.Key([]byte(test.password), []byte(test.salt), test.iterations, len(test.key)/2, sha1.New)); key != test.key {
+			t.Errorf("Expected PBKDF2 key %s for %q, got %s", test.key, test.password, key)
+		}
+	}
+	if key := fmt.Sprintf("%x", credentialKey("password", []byte("salt"), 4096)); key != "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a" {
+		t.Errorf("Unexpected PBKDF2 key %s", key)
+	}
+
+	dir := testDir(t, "")
+	passphrase := "open sesame"
+	stores := map[string]CredentialStore{
+		"file": NewFileCredentialStore(filepath.Join(dir, ".test.d/credentials.json")),
+		"encrypted": NewEncryptedCredentialStore(filepath.Join(dir, ".test.d/credentials.enc"), func() (string, error) {
+			return passphrase, nil
+		}),
+	}
+	for name, store := range stores {
+		store.Store(Credential{Host: "example.com", Username: "bob", Password: "secret"})
+		store.Store(Credential{Host: "example.com", Username: "alice", Password: "hunter2"})
+		store.Store(Credential{Host: "example.com", Username: "bob", Password: "changed"})
+		if cred, err := store.Get(Credential{Host: "example.com", Username: "bob"}); err != nil || cred.Password != "changed" {
+			t.Errorf("%s: Expected stored password for bob, got %v, %v", name, cred, err)
+		}
+		if err := store.Erase(Credential{Host: "example.com", Username: "bob"}); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if cred, err := store.Get(Credential{Host: "example.com"}); err != nil || cred.Username != "alice" {
+			t.Errorf("%s: Expected credential for alice, got %v, %v", name, cred, err)
+		}
+		if _, err := store.Get(Credential{Host: "example.com", Username: "bob"}); err != (CredentialNotFoundError{Host: "example.com", Username: "bob"}) {
+			t.Errorf("%s: Expected CredentialNotFoundError, got %v", name, err)
+		}
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, ".test.d/credentials.enc")); bytes.Contains(content, []byte("hunter2")) {
+		t.Errorf("Expected encrypted credentials, got %s", content)
+	}
+	passphrase = "wrong"
+	if _, err := stores["encrypted"].Get(Credential{Host: "example.com"}); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("Expected decryption to fail, got %v", err)
+	}
+
+	helper := filepath.Join(dir, "helper")
+	ioutil.WriteFile(helper, []byte(`#!/bin/sh
+input=$(cat)
+case "$1" in
+get)
+    echo "$input" | grep -q host=api.example.com && printf 'username=bot\npassword=t0ken\n'
+    ;;
+store)
+    echo "$input" > "$(dirname "$0")/stored"
+    ;;
+esac
+`), 0755)
+	store := &HelperCredentialStore{Command: helper}
+	if cred, err := store.Get(Credential{Protocol: "https", Host: "api.example.com"}); err != nil || cred != (Credential{Protocol: "https", Host: "api.example.com", Username: "bot", Password: "t0ken"}) {
+		t.Errorf("Expected credential from helper, got %v, %v", cred, err)
+	}
+	if _, err := store.Get(Credential{Host: "example.com"}); err == nil {
+		t.Errorf("Expected CredentialNotFoundError from helper")
+	}
+	store.Store(Credential{Host: "example.com", Username: "bob", OAuthRefreshToken: "r1"})
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, "stored")); string(content) != "host=example.com\nusername=bob\noauth_refresh_token=r1\n" {
+		t.Errorf("Expected credential on helper stdin, got %q", content)
+	}
+	for _, cred := range []Credential{
+		{Host: "example.com", Username: "bob\nhost=evil.com"},
+		{Host: "example.com\x00", Password: "secret"},
+		{Host: "example.com", OAuthRefreshToken: "r2\n"},
+	} {
+		if err := store.Store(cred); err == nil {
+			t.Errorf("Expected %q to be rejected", cred)
+		}
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, "stored")); string(content) != "host=example.com\nusername=bob\noauth_refresh_token=r1\n" {
+		t.Errorf("Expected helper not to run for rejected credentials, got %q", content)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			r.ParseForm()
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token":"token-for-%s","refresh_token":"rotated"}`, r.Form.Get("refresh_token"))
+			return
+		}
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	ioutil.WriteFile(".test.d/config.yml", []byte(`
+credential-store:
+  type: file
+  file: `+filepath.Join(dir, "creds.json")+`
+auth:
+  http://`+host+`:
+    type: basic
+    user: bob
+  http://localhost:
+    type: oauth2
+    token-url: `+server.URL+`/token
+    client-id: my-tool
+`), 0644)
+	files := NewFileCredentialStore(filepath.Join(dir, "creds.json"))
+	files.Store(Credential{Host: host, Username: "bob", Password: "secret"})
+	files.Store(Credential{Host: "localhost", Username: "my-tool", Password: "s3cret", OAuthRefreshToken: "saved"})
+
+	cli := New("test")
+	cli.SetCookieFile("")
+	resp, err := cli.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "Basic Ym9iOnNlY3JldA==" {
+		t.Errorf("Expected password from the credential store, got %q", body)
+	}
+
+	resp, err = cli.Get(strings.Replace(server.URL, "127.0.0.1", "localhost", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "Bearer token-for-saved" {
+		t.Errorf("Expected saved refresh token to be used, got %q", body)
+	}
+	if cred, _ := files.Get(Credential{Host: "localhost", Username: "my-tool"}); cred.OAuthRefreshToken != "rotated" || cred.Password != "s3cret" {
+		t.Errorf("Expected rotated refresh token to be saved, got %v", cred)
+	}
+
+	// executable configs can select the store too
+	os.Mkdir(".test.d/config.d", 0755)
+	ioutil.WriteFile(".test.d/config.d/10-store.yml", []byte("#!/bin/sh\necho 'credential-store: {type: helper, helper: "+helper+"}'\n"), 0755)
+	if store, ok := New("test").GetCredentialStore().(*HelperCredentialStore); !ok || store.Command != helper {
+		t.Errorf("Expected the helper store from the executable config, got %#v", store)
+	}
+}
@@ -0,0 +1,225 @@
+package cliby
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/coryb/cliby.v1/util"
+	"gopkg.in/coryb/yaml.v2"
+)
+
+// CustomCommand is a command defined in the "custom-commands" list of a
+// config file:
+//
+//	custom-commands:
+//	  - name: mine
+//	    help: List my open issues
+//	    options:
+//	      - name: status
+//	        short: s
+//	        default: open
+//	    args:
+//	      - name: project
+//	        required: true
+//	    script: |
+//	      {{shellquote .self}} issue list --assignee me --status {{shellquote .options.status}} {{shellquote .args.project}}
+//
+// The script is a template rendered with .args and .options holding the
+// parsed arguments and flags, .global the merged global options and .self
+// the path of the running executable, then run with "sh -c".  Values come
+// from the command line and configs, so quote them with shellquote to keep
+// the shell from interpreting them.
+type CustomCommand struct {
+	Name    string                `json:"name" yaml:"name"`
+	Help    string                `json:"help" yaml:"help"`
+	Options []CustomCommandOption `json:"options" yaml:"options"`
+	Args    []CustomCommandArg    `json:"args" yaml:"args"`
+	Script  string                `json:"script" yaml:"script"`
+}
+
+// CustomCommandOption is a flag of a CustomCommand.  Type is "string" (the
+// default), "bool" or "strings" for a repeatable flag.
+type CustomCommandOption struct {
+	Name     string `json:"name" yaml:"name"`
+	Help     string `json:"help" yaml:"help"`
+	Short    string `json:"short" yaml:"short"`
+	Type     string `json:"type" yaml:"type"`
+	Default  string `json:"default" yaml:"default"`
+	Required bool   `json:"required" yaml:"required"`
+}
+
+// CustomCommandArg is a positional argument of a CustomCommand.  Only the
+// last argument can repeat.
+type CustomCommandArg struct {
+	Name     string `json:"name" yaml:"name"`
+	Help     string `json:"help" yaml:"help"`
+	Default  string `json:"default" yaml:"default"`
+	Required bool   `json:"required" yaml:"required"`
+	Repeat   bool   `json:"repeat" yaml:"repeat"`
+}
+
+// loadCustomCommands returns the custom commands from the configs, a command
+// in a closer config replacing one with the same name further away.
+func loadCustomCommands(i Interface) []CustomCommand {
+	commands := []CustomCommand{}
+	seen := make(map[string]bool)
+	for _, config := range configSections(i, "custom-commands") {
+		content, err := yaml.Marshal(config.data)
+		if err != nil {
+			continue
+		}
+		defined := []CustomCommand{}
+		if err := yaml.Unmarshal(content, &defined); err != nil {
+			log.Errorf("Invalid custom-commands in %s: %s", config.file, err)
+			continue
+		}
+		for _, cmd := range defined {
+			cmd.Name = strings.Join(strings.Fields(cmd.Name), " ")
+			if cmd.Name == "" || seen[cmd.Name] {
+				continue
+			}
+			seen[cmd.Name] = true
+			commands = append(commands, cmd)
+		}
+	}
+	return commands
+}
+
+// bindCustomCommands adds the custom commands from the configs to app and
+// registers a handler running each.  Commands already defined on app or
+// registered with AddCommand or AddHandler take precedence over custom
+// commands.  Handlers of custom commands are replaced, so that they read the
+// flags of app when options are processed again.
+func bindCustomCommands(i Interface, app *kingpin.Application) {
+	for _, custom := range loadCustomCommands(i) {
+		if i.GetCommand(custom.Name) != nil || (getHandler(i, custom.Name) != nil && !isCustomCommand(i, custom.Name)) || hasCommandClause(app, custom.Name) {
+			log.Debugf("Ignoring custom command %s, it is already defined", custom.Name)
+			continue
+		}
+		bindCustomCommand(i, app, custom)
+	}
+}
+
+// customCommandHandlers is implemented by Cli to remember which handlers
+// were added for custom commands.
+type customCommandHandlers interface {
+	isCustomCommand(command string) bool
+	addCustomCommand(command string)
+}
+
+func (c *Cli) isCustomCommand(command string) bool {
+	return c.customCommands[command]
+}
+
+func (c *Cli) addCustomCommand(command string) {
+	if c.customCommands == nil {
+		c.customCommands = make(map[string]bool)
+	}
+	c.customCommands[command] = true
+}
+
+func isCustomCommand(i Interface, command string) bool {
+	handlers, ok := i.(customCommandHandlers)
+	return ok && handlers.isCustomCommand(command)
+}
+
+func hasCommandClause(app *kingpin.Application, name string) bool {
+	parts := strings.Fields(name)
+	cmd := app.GetCommand(parts[0])
+	for n := 1; cmd != nil && n < len(parts); n++ {
+		cmd = cmd.GetCommand(parts[n])
+	}
+	return cmd != nil
+}
+
+func bindCustomCommand(i Interface, app *kingpin.Application, custom CustomCommand) {
+	cmd := commandClause(app, custom.Name, custom.Help)
+	options := make(map[string]interface{})
+	for _, opt := range custom.Options {
+		flag := cmd.Flag(opt.Name, opt.Help)
+		if opt.Short != "" {
+			flag.Short(rune(opt.Short[0]))
+		}
+		if opt.Default != "" {
+			flag.Default(opt.Default)
+		}
+		if opt.Required {
+			flag.Required()
+		}
+		switch opt.Type {
+		case "bool":
+			options[opt.Name] = flag.Bool()
+		case "strings":
+			options[opt.Name] = flag.Strings()
+		default:
+			options[opt.Name] = flag.String()
+		}
+	}
+	args := make(map[string]interface{})
+	for _, a := range custom.Args {
+		arg := cmd.Arg(a.Name, a.Help)
+		if a.Default != "" {
+			arg.Default(a.Default)
+		}
+		if a.Required {
+			arg.Required()
+		}
+		if a.Repeat {
+			args[a.Name] = arg.Strings()
+		} else {
+			args[a.Name] = arg.String()
+		}
+	}
+
+	if handlers, ok := i.(customCommandHandlers); ok {
+		handlers.addCustomCommand(custom.Name)
+	}
+	addHandler(i, custom.Name, func(ctx context.Context, _ interface{}, streams IOStreams) error {
+		self, _ := os.Executable()
+		data := map[string]interface{}{
+			"args":    derefValues(args),
+			"options": derefValues(options),
+			"global":  i.GetOptions(),
+			"self":    self,
+		}
+		script := &bytes.Buffer{}
+		if err := util.RunTemplate(custom.Script, data, script); err != nil {
+			return fmt.Errorf("Invalid script for custom command %s: %s", custom.Name, err)
+		}
+		return runScript(ctx, i, script.String(), streams)
+	})
+}
+
+func derefValues(values map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for name, value := range values {
+		switch v := value.(type) {
+		case *string:
+			result[name] = *v
+		case *bool:
+			result[name] = *v
+		case *[]string:
+			result[name] = *v
+		}
+	}
+	return result
+}
+
+// runScript runs script with "sh -c" in the environment populateEnv
+// exports, plus env.  A script exiting non-zero returns an Exit with its exit
+// status.
+func runScript(ctx context.Context, i Interface, script string, streams IOStreams, env ...string) error {
+	populateEnv(i)
+	cmd := exec.CommandContext(ctx, "sh", "-c", script)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = streams.In, streams.Out, streams.Err
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	log.Debugf("Running script: %s", script)
+	return exitStatus(cmd.Run())
+}
@@ -0,0 +1,476 @@
+package cliby
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+type docFlag struct {
+	Name    string
+	Short   string
+	Value   string
+	Help    string
+	Default string
+}
+
+type docArg struct {
+	Name     string
+	Help     string
+	Required bool
+}
+
+type docOption struct {
+	Key     string
+	Flag    string
+	Env     string
+	Type    string
+	Help    string
+	Default string
+}
+
+type docCommand struct {
+	Name string
+	Help string
+	Page string
+}
+
+type docTemplate struct {
+	Name    string
+	Content string
+}
+
+// docPage is the content of the man page or Markdown page for the
+// application or one of its commands.
+type docPage struct {
+	App         string
+	Command     string
+	Page        string
+	Help        string
+	Usage       string
+	Flags       []docFlag
+	Args        []docArg
+	Commands    []docCommand
+	Options     []docOption
+	Templates   []docTemplate
+	ConfigKey   string
+	ConfigFile  string
+	ParentPages []string
+}
+
+// docPageName returns the file name, without extension, of the page for
+// command, e.g. "tool-issue-create".
+func docPageName(app, command string) string {
+	return strings.Join(append([]string{app}, strings.Fields(command)...), "-")
+}
+
+func docFlags(group *kingpin.FlagGroupModel) []docFlag {
+	flags := []docFlag{}
+	for _, flag := range group.Flags {
+		if flag.Hidden {
+			continue
+		}
+		df := docFlag{Name: flag.Name, Help: flag.Help, Default: strings.Join(flag.Default, ", ")}
+		if flag.Short != 0 {
+			df.Short = string(flag.Short)
+		}
+		if !flag.IsBoolFlag() {
+			df.Value = flag.FormatPlaceHolder()
+		}
+		flags = append(flags, df)
+	}
+	return flags
+}
+
+func docArgs(group *kingpin.ArgGroupModel) []docArg {
+	args := []docArg{}
+	for _, arg := range group.Args {
+		args = append(args, docArg{Name: arg.Name, Help: arg.Help, Required: arg.Required})
+	}
+	return args
+}
+
+func docUsage(app string, path []*kingpin.CmdModel, args *kingpin.ArgGroupModel, hasCommands bool) string {
+	usage := []string{app, "[<flags>]"}
+	for _, cmd := range path {
+		usage = append(usage, cmd.Name)
+		if len(cmd.Flags) > 0 {
+			usage = append(usage, "[<flags>]")
+		}
+	}
+	if hasCommands {
+		usage = append(usage, "<command>")
+	}
+	if len(args.Args) > 0 {
+		usage = append(usage, args.ArgSummary())
+	}
+	return strings.Join(usage, " ")
+}
+
+// docOptions describes every field of the options of i: its config key,
+// flag, environment variable and default.
+func docOptions(i Interface) []docOption {
+	options := []docOption{}
+	v := reflect.Indirect(reflect.ValueOf(i.NewOptions()))
+	if v.Kind() != reflect.Struct {
+		return options
+	}
+	defaults := reflect.Indirect(reflect.ValueOf(i.GetDefaults()))
+	for f := 0; f < v.NumField(); f++ {
+		field := v.Type().Field(f)
+		tag := parseClibyTag(field)
+		if field.PkgPath != "" || tag.Skip() {
+			continue
+		}
+		option := docOption{
+			Key:  fieldKey(field),
+			Env:  envName(i, field),
+			Type: field.Type.String(),
+			Help: tag.Get("help"),
+		}
+		if !tag.Has("noflag") {
+			option.Flag = "--" + flagName(field)
+		}
+		if defaults.IsValid() && defaults.Type() == v.Type() && !isZero(defaults.Field(f)) {
+			option.Default = fmt.Sprint(defaults.Field(f).Interface())
+		}
+		options = append(options, option)
+	}
+	return options
+}
+
+// templateLister is implemented by Cli, the templates of other
+// implementations of Interface are not documented.
+type templateLister interface {
+	GetTemplates() map[string]string
+}
+
+func getTemplates(i Interface) map[string]string {
+	if lister, ok := i.(templateLister); ok {
+		return lister.GetTemplates()
+	}
+	return nil
+}
+
+// docPages returns the page for the application followed by a page for
+// every visible command.  Commands from GetCommands that are not defined on
+// app are listed on the application page.
+func docPages(i Interface, app *kingpin.Application) []docPage {
+	model := app.Model()
+	root := docPage{
+		App:        i.Name(),
+		Page:       i.Name(),
+		Help:       model.Help,
+		Usage:      docUsage(i.Name(), nil, model.ArgGroupModel, len(model.Commands) > 0),
+		Flags:      docFlags(model.FlagGroupModel),
+		Args:       docArgs(model.ArgGroupModel),
+		Options:    docOptions(i),
+		ConfigFile: configFileName(i, i.GetDefaults()),
+	}
+	templates := getTemplates(i)
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		root.Templates = append(root.Templates, docTemplate{Name: name, Content: templates[name]})
+	}
+
+	pages := []docPage{}
+	known := make(map[string]bool)
+	var walk func(path []*kingpin.CmdModel, group *kingpin.CmdGroupModel) []docCommand
+	walk = func(path []*kingpin.CmdModel, group *kingpin.CmdGroupModel) []docCommand {
+		commands := []docCommand{}
+		for _, cmd := range group.Commands {
+			known[cmd.FullCommand] = true
+			if cmd.Hidden || (app.HelpCommand != nil && cmd.FullCommand == app.HelpCommand.FullCommand()) {
+				continue
+			}
+			cmdPath := append(append([]*kingpin.CmdModel{}, path...), cmd)
+			page := docPage{
+				App:       i.Name(),
+				Command:   cmd.FullCommand,
+				Page:      docPageName(i.Name(), cmd.FullCommand),
+				Help:      cmd.Help,
+				Usage:     docUsage(i.Name(), cmdPath, cmd.ArgGroupModel, len(cmd.Commands) > 0),
+				Flags:     docFlags(cmd.FlagGroupModel),
+				Args:      docArgs(cmd.ArgGroupModel),
+				ConfigKey: commandKey(cmd.FullCommand),
+			}
+			for n := range path {
+				page.ParentPages = append(page.ParentPages, docPageName(i.Name(), path[n].FullCommand))
+			}
+			n := len(pages)
+			pages = append(pages, page)
+			pages[n].Commands = walk(cmdPath, cmd.CmdGroupModel)
+			commands = append(commands, docCommand{Name: cmd.FullCommand, Help: cmd.Help, Page: page.Page})
+		}
+		return commands
+	}
+	root.Commands = walk(nil, model.CmdGroupModel)
+
+	extra := []string{}
+	for name := range getCommands(i) {
+		if !known[name] {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		root.Commands = append(root.Commands, docCommand{Name: name})
+	}
+	return append([]docPage{root}, pages...)
+}
+
+var docFuncs = template.FuncMap{
+	"roff": func(s string) string {
+		s = strings.Replace(s, `\`, `\e`, -1)
+		lines := strings.Split(s, "\n")
+		for n, line := range lines {
+			if strings.HasPrefix(line, ".") || strings.HasPrefix(line, "'") {
+				lines[n] = `\&` + line
+			}
+		}
+		return strings.Join(lines, "\n")
+	},
+	"dash": func(s string) string {
+		return strings.Replace(s, "-", `\-`, -1)
+	},
+	"upper": strings.ToUpper,
+	"code": func(s string) string {
+		return "`" + strings.Replace(s, "`", "'", -1) + "`"
+	},
+	// cell escapes s for a markdown table cell, where a pipe ends the cell
+	// and a newline the row
+	"cell": func(s string) string {
+		s = strings.Replace(s, "|", `\|`, -1)
+		return strings.Replace(strings.TrimSpace(s), "\n", "<br>", -1)
+	},
+}
+
+var docTemplates = map[string]string{
+	"man": `.TH "{{upper .Page}}" "1" "" "{{.App}}" "{{.App}} Manual"
+.SH NAME
+{{.Page}}{{if .Help}} \- {{roff .Help}}{{end}}
+.SH SYNOPSIS
+.B {{dash (roff .Usage)}}
+{{- if .Help}}
+.SH DESCRIPTION
+{{roff .Help}}
+{{- end}}
+{{- if .Commands}}
+.SH COMMANDS
+{{- range .Commands}}
+.TP
+.B {{roff .Name}}
+{{if .Help}}{{roff .Help}}{{else}}.br{{end}}
+{{- end}}
+{{- end}}
+{{- if .Flags}}
+.SH FLAGS
+{{- range .Flags}}
+.TP
+{{if .Short}}\fB\-{{.Short}}\fR, {{end}}\fB\-\-{{dash .Name}}\fR{{if .Value}} \fI{{roff .Value}}\fR{{end}}
+{{if .Help}}{{roff .Help}}{{else}}.br{{end}}
+{{- end}}
+{{- end}}
+{{- if .Args}}
+.SH ARGUMENTS
+{{- range .Args}}
+.TP
+\fI{{.Name}}\fR{{if not .Required}} (optional){{end}}
+{{if .Help}}{{roff .Help}}{{else}}.br{{end}}
+{{- end}}
+{{- end}}
+{{- if .Options}}
+.SH OPTIONS
+Options can be set with flags, environment variables, or in
+.I {{roff .ConfigFile}}
+files found in the current directory and its parents.
+{{- range .Options}}
+.TP
+.B {{roff .Key}}
+{{if .Help}}{{roff .Help}}
+.br
+{{end}}Type: {{roff .Type}}{{if .Flag}}, flag: {{dash .Flag}}{{end}}, environment: {{roff .Env}}{{if .Default}}, default: {{roff .Default}}{{end}}
+{{- end}}
+{{- end}}
+{{- if .ConfigKey}}
+.SH CONFIGURATION
+Options for this command can be set in configs under the
+.B {{roff .ConfigKey}}
+key.
+{{- end}}
+{{- if .Templates}}
+.SH TEMPLATES
+{{- range .Templates}}
+.TP
+.B {{roff .Name}}
+.nf
+{{roff .Content}}
+.fi
+{{- end}}
+{{- end}}
+{{- if or .ParentPages .Commands}}
+.SH SEE ALSO
+{{- range .ParentPages}}
+.BR {{.}} (1)
+{{- end}}
+{{- range .Commands}}{{if .Page}}
+.BR {{.Page}} (1)
+{{- end}}{{end}}
+{{- end}}
+`,
+	"markdown": `# {{.Page}}
+{{if .Help}}
+{{.Help}}
+{{end}}
+## Synopsis
+
+` + "```" + `
+{{.Usage}}
+` + "```" + `
+{{- if .Commands}}
+
+## Commands
+{{range .Commands}}
+* {{if .Page}}[{{.Name}}]({{.Page}}.md){{else}}{{.Name}}{{end}}{{if .Help}} - {{.Help}}{{end}}
+{{- end}}
+{{- end}}
+{{- if .Flags}}
+
+## Flags
+
+| Flag | Description | Default |
+| --- | --- | --- |
+{{- range .Flags}}
+| {{if .Short}}{{code (printf "-%s" .Short)}}, {{end}}{{code (printf "--%s" .Name)}}{{if .Value}} {{cell (code .Value)}}{{end}} | {{cell .Help}} | {{cell .Default}} |
+{{- end}}
+{{- end}}
+{{- if .Args}}
+
+## Arguments
+
+| Argument | Description | Required |
+| --- | --- | --- |
+{{- range .Args}}
+| {{code .Name}} | {{cell .Help}} | {{if .Required}}yes{{else}}no{{end}} |
+{{- end}}
+{{- end}}
+{{- if .Options}}
+
+## Options
+
+Options can be set with flags, environment variables, or in {{code .ConfigFile}} files found in the current directory and its parents.
+
+| Config key | Flag | Environment | Type | Description | Default |
+| --- | --- | --- | --- | --- | --- |
+{{- range .Options}}
+| {{code .Key}} | {{if .Flag}}{{code .Flag}}{{end}} | {{code .Env}} | {{cell .Type}} | {{cell .Help}} | {{cell .Default}} |
+{{- end}}
+{{- end}}
+{{- if .ConfigKey}}
+
+## Configuration
+
+Options for this command can be set in configs under the {{code .ConfigKey}} key.
+{{- end}}
+{{- if .Templates}}
+
+## Templates
+{{range .Templates}}
+### {{.Name}}
+
+` + "```" + `
+{{.Content}}
+` + "```" + `
+{{- end}}
+{{- end}}
+{{- if .ParentPages}}
+
+## See Also
+{{range .ParentPages}}
+* [{{.}}]({{.}}.md)
+{{- end}}
+{{- end}}
+`,
+}
+
+// docExt is the file extension for each documentation format.
+var docExt = map[string]string{
+	"man":      "1",
+	"markdown": "md",
+}
+
+// WriteDocs writes a reference page in format (man or markdown) for the
+// application and each visible command of app to out, one after another.
+func WriteDocs(i Interface, app *kingpin.Application, format string, out io.Writer) error {
+	return writeDocs(i, app, format, func(string) (io.WriteCloser, error) {
+		return nopWriteCloser{out}, nil
+	})
+}
+
+// GenerateDocs writes a reference page in format (man or markdown) for the
+// application and each visible command of app into dir, named like
+// tool.1 and tool-issue-create.1 for man pages.
+func GenerateDocs(i Interface, app *kingpin.Application, format, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return writeDocs(i, app, format, func(page string) (io.WriteCloser, error) {
+		return os.Create(filepath.Join(dir, fmt.Sprintf("%s.%s", page, docExt[format])))
+	})
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func writeDocs(i Interface, app *kingpin.Application, format string, open func(string) (io.WriteCloser, error)) error {
+	content, ok := docTemplates[format]
+	if !ok {
+		return fmt.Errorf("Unknown docs format %q, expected man or markdown", format)
+	}
+	tmpl := template.Must(template.New(format).Funcs(docFuncs).Parse(content))
+	for _, page := range docPages(i, app) {
+		out, err := open(page.Page)
+		if err != nil {
+			return err
+		}
+		err = tmpl.Execute(out, page)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddDocsCommand registers the hidden "generate-docs" command on app, which
+// writes man pages or Markdown pages for app into a directory.  Like
+// AddConfigCommand it is opt-in, call it from CommandLine().
+func AddDocsCommand(i Interface, app *kingpin.Application) {
+	format := "man"
+	dir := "."
+	cmd := app.Command("generate-docs", "Generate reference documentation").Hidden()
+	cmd.Flag("format", "Output format: man or markdown").Default("man").EnumVar(&format, "man", "markdown")
+	cmd.Flag("dir", "Directory to write the pages to").Default(".").StringVar(&dir)
+	addHandler(i, "generate-docs", func(ctx context.Context, options interface{}, streams IOStreams) error {
+		return GenerateDocs(i, app, format, dir)
+	})
+}
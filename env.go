@@ -0,0 +1,181 @@
+package cliby
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/fatih/camelcase"
+)
+
+// envName returns the environment variable for an option field, e.g.
+// ConfigFile for a Cli named "jira" is JIRA_CONFIG_FILE.  populateEnv
+// exports options with these names and loadEnv reads them back.  The name
+// can be overridden with the `cliby:"env=NAME"` struct tag.
+func envName(iface Interface, field reflect.StructField) string {
+	if name := parseClibyTag(field).Get("env"); name != "" {
+		return name
+	}
+	name := strings.Join(camelcase.Split(field.Name), "_")
+	envName := fmt.Sprintf("%s_%s", strings.ToUpper(iface.Name()), strings.ToUpper(name))
+
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) || unicode.IsLetter(r) {
+			return r
+		}
+		return '_'
+	}, envName)
+}
+
+// exportedEnvName returns the variable populateEnv lists the variables it
+// exported in, e.g. JIRA_EXPORTED_ENV for a Cli named "jira".
+func exportedEnvName(iface Interface) string {
+	return fmt.Sprintf("%s_EXPORTED_ENV", strings.ToUpper(iface.Name()))
+}
+
+// setOptionEnv exports the option variables in values, and adds them to the
+// exportedEnvName variable, a JSON object of the exported values.  They are
+// inherited by the commands the cli runs, which can be the cli again.
+func setOptionEnv(iface Interface, values map[string]string) {
+	exported := exportedEnv(iface)
+	for name, value := range values {
+		os.Setenv(name, value)
+		exported[name] = value
+	}
+	content, _ := json.Marshal(exported)
+	os.Setenv(exportedEnvName(iface), string(content))
+}
+
+// exportedEnv returns the variables listed by setOptionEnv, in this process
+// or a parent one.
+func exportedEnv(iface Interface) map[string]string {
+	exported := make(map[string]string)
+	if content := os.Getenv(exportedEnvName(iface)); content != "" {
+		if err := json.Unmarshal([]byte(content), &exported); err != nil {
+			log.Debugf("Ignoring %s: %s", exportedEnvName(iface), err)
+		}
+	}
+	return exported
+}
+
+// optionEnv returns the value of an option environment variable and whether
+// it is set, ignoring variables that still hold the value populateEnv
+// exported, so that options are not set back from their own export.
+func optionEnv(name string, exported map[string]string) (string, bool) {
+	value, ok := os.LookupEnv(name)
+	if previous, found := exported[name]; ok && found && previous == value {
+		return "", false
+	}
+	return value, ok
+}
+
+// loadEnv merges the option environment variables into the options of
+// iface.  Environment variables take precedence over config files but not
+// over the command line.  Variables set to an empty string set the zero
+// value of the option.  Like populateEnv,
+// struct options and pointers to them are supported, map options have no
+// fields to name variables after and are left alone.
+func loadEnv(iface Interface, state *mergeState) error {
+	options := reflect.ValueOf(iface.GetOptions())
+	var ov reflect.Value
+	switch {
+	case options.Kind() == reflect.Ptr && options.Elem().Kind() == reflect.Struct:
+		ov = options.Elem()
+	case options.Kind() == reflect.Struct:
+		// merge into an addressable copy, which replaces the options
+		ov = reflect.New(options.Type()).Elem()
+		ov.Set(options)
+		options = ov
+	default:
+		return nil
+	}
+	nv := reflect.New(ov.Type()).Elem()
+	exported := exportedEnv(iface)
+	present := make(map[string]bool)
+	names := make(map[string]string)
+	for i := 0; i < ov.NumField(); i++ {
+		field := ov.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := envName(iface, field)
+		value, ok := optionEnv(name, exported)
+		if !ok {
+			continue
+		}
+		if err := parseEnvValue(nv.Field(i), value); err != nil {
+			return EnvParseError{Name: name, Value: value, Err: err}
+		}
+		key := fieldKey(field)
+		present[key] = true
+		names[key] = name
+	}
+	if len(present) == 0 {
+		return nil
+	}
+
+	log.Debugf("Setting Config from environment")
+	m := &merger{
+		source: ConfigSource{Kind: SourceEnv},
+		record: func(key string, source ConfigSource) {
+			source.Env = names[key]
+			setSource(iface, key, source)
+		},
+		state:   state,
+		present: present,
+	}
+	m.mergeStructs("", options, nv)
+	iface.SetOptions(options.Interface())
+	return nil
+}
+
+func parseEnvValue(v reflect.Value, value string) error {
+	if value == "" {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return json.Unmarshal([]byte(value), v.Addr().Interface())
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package cliby
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ConfigParseError is returned when a config file, or the output of an
+// executable config, cannot be parsed.  Line is 0 when the parser did not
+// report one.
+type ConfigParseError struct {
+	File string
+	Line int
+	Exec bool
+	Err  error
+}
+
+func (e ConfigParseError) Error() string {
+	if e.Exec {
+		return fmt.Sprintf("Failed to parse STDOUT from executable config file %s: %s", e.File, e.Err)
+	}
+	return fmt.Sprintf("Unable to parse %s: %s", e.File, e.Err)
+}
+
+// ConfigExecError is returned when an executable config fails to run.
+// ExitStatus is -1 when the command could not be started at all.
+type ConfigExecError struct {
+	File       string
+	ExitStatus int
+	Stderr     string
+	Err        error
+}
+
+func (e ConfigExecError) Error() string {
+	return fmt.Sprintf("%s is exectuable, but it failed to execute: %s\n%s", e.File, e.Err, e.Stderr)
+}
+
+// ConfigIncludeError is returned when the include directive of a config
+// file is invalid, names a file that does not exist, or forms a cycle.
+type ConfigIncludeError struct {
+	File    string
+	Include string
+	Err     error
+}
+
+func (e ConfigIncludeError) Error() string {
+	if e.Include == "" {
+		return fmt.Sprintf("Invalid include in %s: %s", e.File, e.Err)
+	}
+	return fmt.Sprintf("Unable to include %s from %s: %s", e.Include, e.File, e.Err)
+}
+
+// EnvParseError is returned when an option environment variable cannot be
+// parsed into the type of its option.
+type EnvParseError struct {
+	Name  string
+	Value string
+	Err   error
+}
+
+func (e EnvParseError) Error() string {
+	return fmt.Sprintf("Unable to parse %s=%q: %s", e.Name, e.Value, e.Err)
+}
+
+// MissingOptionError is returned when an option tagged `cliby:"required"`
+// was not set by the command line, the environment, a config or the
+// defaults.
+type MissingOptionError struct {
+	Key  string
+	Flag string
+	Env  string
+}
+
+func (e MissingOptionError) Error() string {
+	return fmt.Sprintf("Required option %s not set, use %s, %s or the %q config key", e.Key, e.Flag, e.Env, e.Key)
+}
+
+// UnknownCommandError is returned when a command is not registered.
+// Suggestions holds the registered commands and aliases closest to Name,
+// best match first.
+type UnknownCommandError struct {
+	Name        string
+	Suggestions []string
+}
+
+func (e UnknownCommandError) Error() string {
+	msg := fmt.Sprintf("Command %s Unknown", e.Name)
+	if len(e.Suggestions) > 0 {
+		msg += "\n\nDid you mean this?\n\t" + strings.Join(e.Suggestions, "\n\t")
+	}
+	return msg
+}
+
+// ResponseError is returned by DecodeResponse for a response with a non-2xx
+// status.  Body holds the content of the response.
+type ResponseError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (e ResponseError) Error() string {
+	return fmt.Sprintf("%s %s failed: %s", e.Method, e.URL, e.Status)
+}
+
+// CredentialNotFoundError is returned by a CredentialStore without a
+// credential for Host, and Username when it is set.
+type CredentialNotFoundError struct {
+	Host     string
+	Username string
+}
+
+func (e CredentialNotFoundError) Error() string {
+	if e.Username == "" {
+		return fmt.Sprintf("No credentials stored for %s", e.Host)
+	}
+	return fmt.Sprintf("No credentials stored for %s@%s", e.Username, e.Host)
+}
+
+var parseErrorLine = regexp.MustCompile(`line (\d+)`)
+
+func newConfigParseError(file string, isExec bool, err error) ConfigParseError {
+	parseErr := ConfigParseError{File: file, Exec: isExec, Err: err}
+	if match := parseErrorLine.FindStringSubmatch(err.Error()); match != nil {
+		parseErr.Line, _ = strconv.Atoi(match[1])
+	}
+	return parseErr
+}
+
+func newConfigExecError(file, stderr string, err error) ConfigExecError {
+	execErr := ConfigExecError{File: file, ExitStatus: -1, Stderr: stderr, Err: err}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		execErr.ExitStatus = exitErr.ExitCode()
+	}
+	return execErr
+}
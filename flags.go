@@ -0,0 +1,212 @@
+package cliby
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// flagger is implemented by both *kingpin.Application and *kingpin.CmdClause.
+type flagger interface {
+	Flag(name, help string) *kingpin.FlagClause
+}
+
+// BindFlags registers a kingpin flag on app for every exported field of the
+// options of i, creating them with NewOptions() if needed.  The options must
+// be a pointer to a struct.  Flags are named after the config key of the
+// field, its yaml or json tag or else its lowercased name, and can be tuned
+// with the cliby tag:
+//
+//	Project string `json:"project" cliby:"help='Project key',short=p,env=PROJECT,required"`
+//
+// help sets the flag help text, short a one letter alias, env overrides the
+// environment variable read for the option, and required makes processing
+// fail when no source sets the option.  noflag skips the flag but keeps the
+// option in configs and the environment, while "-" skips the field entirely.
+// Flag values are completed with the Completer added for the option key, see
+// AddCompleter.
+func BindFlags(i Interface, app *kingpin.Application) error {
+	options := i.GetOptions()
+	if options == nil {
+		options = i.NewOptions()
+		i.SetOptions(options)
+	}
+	return bindFlags(i, app, "", options)
+}
+
+func bindFlags(i Interface, clause flagger, prefix string, options interface{}) error {
+	v := reflect.ValueOf(options)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Unable to bind flags to %T, options must be a pointer to a struct", options)
+	}
+	v = v.Elem()
+	for f := 0; f < v.NumField(); f++ {
+		field := v.Type().Field(f)
+		tag := parseClibyTag(field)
+		if field.PkgPath != "" || tag.Skip() || tag.Has("noflag") {
+			continue
+		}
+		key := joinKey(prefix, fieldKey(field))
+		flag := clause.Flag(flagName(field), tag.Get("help"))
+		if short := tag.Get("short"); short != "" {
+			flag.Short(rune(short[0]))
+		}
+		flag.Action(func(*kingpin.ParseContext) error {
+			setSource(i, key, ConfigSource{Kind: SourceCommandLine})
+			return nil
+		})
+		flag.HintAction(func() []string {
+			if fn := getCompleter(i, key); fn != nil {
+				return fn()
+			}
+			return nil
+		})
+		bindFlagValue(flag, v.Field(f))
+	}
+	return nil
+}
+
+// flagName returns the flag for a struct field, which is the config key of
+// the field so that --name on the command line sets name in the configs.
+func flagName(field reflect.StructField) string {
+	return fieldKey(field)
+}
+
+func bindFlagValue(flag *kingpin.FlagClause, v reflect.Value) {
+	switch target := v.Addr().Interface().(type) {
+	case *string:
+		flag.StringVar(target)
+	case *bool:
+		flag.BoolVar(target)
+	case *int:
+		flag.IntVar(target)
+	case *int64:
+		flag.Int64Var(target)
+	case *uint:
+		flag.UintVar(target)
+	case *uint64:
+		flag.Uint64Var(target)
+	case *float64:
+		flag.Float64Var(target)
+	case *time.Duration:
+		flag.DurationVar(target)
+	case *[]string:
+		flag.StringsVar(target)
+	case *map[string]string:
+		flag.PlaceHolder("KEY=VALUE").SetValue(&stringMapValue{target})
+	default:
+		flag.PlaceHolder("JSON").SetValue(&jsonValue{v})
+	}
+}
+
+// stringMapValue is like kingpin's StringMap but allocates the map on first
+// use so unset options keep a nil map.
+type stringMapValue struct {
+	m *map[string]string
+}
+
+func (s *stringMapValue) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected KEY=VALUE got '%s'", value)
+	}
+	if *s.m == nil {
+		*s.m = make(map[string]string)
+	}
+	(*s.m)[parts[0]] = parts[1]
+	return nil
+}
+
+func (s *stringMapValue) String() string {
+	return fmt.Sprintf("%s", *s.m)
+}
+
+func (s *stringMapValue) IsCumulative() bool {
+	return true
+}
+
+// jsonValue is a kingpin.Value for option types without a native kingpin
+// parser, the flag value is decoded as JSON.
+type jsonValue struct {
+	v reflect.Value
+}
+
+func (j *jsonValue) Set(value string) error {
+	return json.Unmarshal([]byte(value), j.v.Addr().Interface())
+}
+
+func (j *jsonValue) String() string {
+	content, _ := json.Marshal(j.v.Interface())
+	return string(content)
+}
+
+// recordFlags records the options set by the flags given on the command line
+// parsed into ctx, so that flags registered by hand count as set like those of
+// BindFlags, even when given a zero value like --no-verbose.  A flag is matched
+// to the option of the command it was registered on, or else the global
+// option, with the config key of its name.
+func recordFlags(i Interface, ctx *kingpin.ParseContext) {
+	commands := []*kingpin.CmdClause{}
+	for _, element := range ctx.Elements {
+		switch clause := element.Clause.(type) {
+		case *kingpin.CmdClause:
+			commands = append(commands, clause)
+		case *kingpin.FlagClause:
+			name := clause.Model().Name
+			prefix, options := "", i.GetOptions()
+			for n := len(commands) - 1; n >= 0; n-- {
+				if commands[n].GetFlag(name) == clause {
+					prefix = commandKey(commands[n].FullCommand())
+					options = nil
+					if cmd, ok := getRegisteredCommands(i)[commands[n].FullCommand()]; ok {
+						options = cmd.Options
+					}
+					break
+				}
+			}
+			if hasOption(options, name) {
+				setSource(i, joinKey(prefix, name), ConfigSource{Kind: SourceCommandLine})
+			}
+		}
+	}
+}
+
+// hasOption returns true when key is a top level key of options.
+func hasOption(options interface{}, key string) bool {
+	v := reflect.Indirect(reflect.ValueOf(options))
+	switch v.Kind() {
+	case reflect.Map:
+		return true
+	case reflect.Struct:
+		for f := 0; f < v.NumField(); f++ {
+			if field := v.Type().Field(f); field.PkgPath == "" && !parseClibyTag(field).Skip() && fieldKey(field) == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateRequired returns a MissingOptionError for the first option tagged
+// required that was not set by any source.
+func validateRequired(iface Interface, state *mergeState) error {
+	v := reflect.Indirect(reflect.ValueOf(iface.GetOptions()))
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	for f := 0; f < v.NumField(); f++ {
+		field := v.Type().Field(f)
+		if !parseClibyTag(field).Has("required") {
+			continue
+		}
+		key := fieldKey(field)
+		if !state.set[key] && isZero(v.Field(f)) {
+			return MissingOptionError{Key: key, Flag: "--" + flagName(field), Env: envName(iface, field)}
+		}
+	}
+	return nil
+}
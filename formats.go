@@ -0,0 +1,190 @@
+package cliby
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/hashicorp/hcl"
+	"gopkg.in/coryb/yaml.v2"
+)
+
+// ConfigFormat unmarshals config content into v.  Non-YAML formats are
+// decoded into a generic value first and then re-encoded as YAML so that
+// options get identical merge semantics no matter which format supplied
+// them.
+type ConfigFormat func(content []byte, v interface{}) error
+
+var configFormats = map[string]ConfigFormat{
+	"yml":  yaml.Unmarshal,
+	"yaml": yaml.Unmarshal,
+	"json": unmarshalJSON,
+	"toml": toml.Unmarshal,
+	"hcl":  unmarshalHCL,
+}
+
+// unmarshalJSON is json.Unmarshal, except that numbers decoded into a
+// generic value are integers when they have no fraction, like in YAML, rather
+// than float64 which loses the precision of integers above 2^53.
+func unmarshalJSON(content []byte, v interface{}) error {
+	target, ok := v.(*interface{})
+	if !ok {
+		return json.Unmarshal(content, v)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var data interface{}
+	if err := decoder.Decode(&data); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("invalid character after top-level value")
+	}
+	*target = jsonNumbers(data)
+	return nil
+}
+
+// jsonNumbers replaces the json.Numbers in data with an int64, a uint64 or a
+// float64, whichever holds the number.
+func jsonNumbers(data interface{}) interface{} {
+	switch value := data.(type) {
+	case map[string]interface{}:
+		for k, v := range value {
+			value[k] = jsonNumbers(v)
+		}
+	case []interface{}:
+		for n, v := range value {
+			value[n] = jsonNumbers(v)
+		}
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(value.String(), 10, 64); err == nil {
+			return u
+		}
+		f, _ := value.Float64()
+		return f
+	}
+	return data
+}
+
+// unmarshalHCL is hcl.Unmarshal, except that blocks decoded into a generic
+// value are maps like in the other formats.  HCL decodes every block as a
+// list of maps, so that a block can be repeated, and the lists holding a
+// single map are replaced with the map.
+func unmarshalHCL(content []byte, v interface{}) error {
+	if err := hcl.Unmarshal(content, v); err != nil {
+		return err
+	}
+	if target, ok := v.(*interface{}); ok {
+		*target = hclBlocks(*target)
+	}
+	return nil
+}
+
+func hclBlocks(data interface{}) interface{} {
+	switch value := data.(type) {
+	case map[string]interface{}:
+		for k, v := range value {
+			value[k] = hclBlocks(v)
+		}
+	case []map[string]interface{}:
+		if len(value) == 1 {
+			return hclBlocks(value[0])
+		}
+		list := make([]interface{}, len(value))
+		for n, v := range value {
+			list[n] = hclBlocks(v)
+		}
+		return list
+	case []interface{}:
+		if len(value) == 1 {
+			if block, ok := value[0].(map[string]interface{}); ok {
+				return hclBlocks(block)
+			}
+		}
+		for n, v := range value {
+			value[n] = hclBlocks(v)
+		}
+	}
+	return data
+}
+
+// RegisterConfigFormat makes LoadConfigs look for config files with the
+// given extension (without the leading dot) and decode them with format.
+func RegisterConfigFormat(ext string, format ConfigFormat) {
+	configFormats[strings.TrimPrefix(ext, ".")] = format
+}
+
+func GetConfigFormat(ext string) ConfigFormat {
+	return configFormats[strings.TrimPrefix(ext, ".")]
+}
+
+func configExt(file string) string {
+	return strings.TrimPrefix(filepath.Ext(file), ".")
+}
+
+func isYAML(ext string) bool {
+	return ext == "yml" || ext == "yaml"
+}
+
+// configFileNames returns configFile along with a variant for every other
+// registered format, ordered by precedence lowest first so configFile
+// itself wins over its variants in the same directory.
+func configFileNames(configFile string) []string {
+	ext := configExt(configFile)
+	if _, ok := configFormats[ext]; !ok {
+		return []string{configFile}
+	}
+	base := strings.TrimSuffix(configFile, filepath.Ext(configFile))
+	exts := make([]string, 0, len(configFormats))
+	for other := range configFormats {
+		if other != ext {
+			exts = append(exts, other)
+		}
+	}
+	sort.Strings(exts)
+	names := make([]string, 0, len(exts)+1)
+	for _, other := range exts {
+		names = append(names, base+"."+other)
+	}
+	return append(names, configFile)
+}
+
+// decodeConfig unmarshals content from file into v using the format
+// registered for ext, falling back to YAML for unknown extensions.
+func decodeConfig(ext string, content []byte, v interface{}) error {
+	format, ok := configFormats[ext]
+	if !ok || isYAML(ext) {
+		return yaml.Unmarshal(content, v)
+	}
+	var data interface{}
+	if err := format(content, &data); err != nil {
+		return err
+	}
+	content, err := yaml.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(content, v)
+}
+
+var execFormatLine = regexp.MustCompile(`^#\s*format:?\s*(\S+)\s*\n`)
+
+// execOutputFormat returns the format of the output of an executable config
+// and the output to decode.  The format is taken from the file extension
+// unless the output starts with a "#format <ext>" line.
+func execOutputFormat(file string, output []byte) (string, []byte) {
+	if match := execFormatLine.FindSubmatch(output); match != nil {
+		return strings.TrimPrefix(string(match[1]), "."), bytes.TrimPrefix(output, match[0])
+	}
+	return configExt(file), output
+}
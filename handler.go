@@ -0,0 +1,171 @@
+package cliby
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// IOStreams are the input and output streams passed to a Handler, so that
+// handlers do not have to write to os.Stdout directly.
+type IOStreams struct {
+	In  io.Reader
+	Out io.Writer
+	Err io.Writer
+}
+
+func StdStreams() IOStreams {
+	return IOStreams{In: os.Stdin, Out: os.Stdout, Err: os.Stderr}
+}
+
+// Handler is a context aware command function.  ctx is cancelled when the
+// process receives SIGINT or SIGTERM, options are the resolved options of
+// the command (or the global options for commands without their own).
+type Handler func(ctx context.Context, options interface{}, streams IOStreams) error
+
+// Interrupted is returned by RunCommand when a Handler was cancelled by a
+// signal.
+type Interrupted struct {
+	Signal os.Signal
+}
+
+func (e Interrupted) Error() string {
+	return fmt.Sprintf("interrupted by %s", e.Signal)
+}
+
+// ExitCode returns the process exit status for an error returned by
+// RunCommand or ProcessAllOptionsE: 0 for nil, the code of an Exit, 128 plus
+// the signal number for Interrupted (130 for SIGINT) and 1 otherwise.
+func ExitCode(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case Exit:
+		return e.Code
+	case Interrupted:
+		if sig, ok := e.Signal.(syscall.Signal); ok {
+			return 128 + int(sig)
+		}
+		return 130
+	}
+	return 1
+}
+
+func (c *Cli) AddHandler(command string, fn Handler) {
+	if c.handlers == nil {
+		c.handlers = make(map[string]Handler)
+	}
+	c.handlers[command] = fn
+}
+
+func (c *Cli) GetHandler(command string) Handler {
+	return c.handlers[command]
+}
+
+func (c *Cli) GetHandlers() map[string]Handler {
+	return c.handlers
+}
+
+func (c *Cli) SetStreams(streams IOStreams) {
+	c.streams = &streams
+}
+
+// GetStreams returns the streams passed to handlers, StdStreams() unless set
+// with SetStreams.
+func (c *Cli) GetStreams() IOStreams {
+	if c.streams == nil {
+		return StdStreams()
+	}
+	return *c.streams
+}
+
+// handlerRegistry, streamsGetter and handlerLister are implemented by Cli.
+// Other implementations of Interface get handlers added as commands running
+// them, with StdStreams().
+type handlerRegistry interface {
+	AddHandler(string, Handler)
+	GetHandler(string) Handler
+}
+
+type streamsGetter interface {
+	GetStreams() IOStreams
+}
+
+type handlerLister interface {
+	GetHandlers() map[string]Handler
+}
+
+func addHandler(i Interface, command string, fn Handler) {
+	if registry, ok := i.(handlerRegistry); ok {
+		registry.AddHandler(command, fn)
+		return
+	}
+	addCommand(i, command, func() error {
+		return runCancellable(command, func(ctx context.Context) error {
+			return fn(ctx, commandOptions(i, command), getStreams(i))
+		})
+	})
+}
+
+func getHandler(i Interface, command string) Handler {
+	if registry, ok := i.(handlerRegistry); ok {
+		return registry.GetHandler(command)
+	}
+	return nil
+}
+
+func getHandlers(i Interface) map[string]Handler {
+	if lister, ok := i.(handlerLister); ok {
+		return lister.GetHandlers()
+	}
+	return nil
+}
+
+func getStreams(i Interface) IOStreams {
+	if getter, ok := i.(streamsGetter); ok {
+		return getter.GetStreams()
+	}
+	return StdStreams()
+}
+
+// commandOptions returns the options passed to the Handler of command.
+func commandOptions(i Interface, command string) interface{} {
+	if cmd, ok := getRegisteredCommands(i)[command]; ok && cmd.Options != nil {
+		return cmd.Options
+	}
+	return i.GetOptions()
+}
+
+// runCancellable runs fn with a context that is cancelled on SIGINT or
+// SIGTERM.  Only the first signal is caught, a second one gets its default
+// action so a handler ignoring the context can still be killed.
+func runCancellable(command string, fn func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	received := make(chan os.Signal, 1)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Debugf("Received %s, cancelling %s", sig, command)
+			signal.Stop(signals)
+			received <- sig
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := fn(ctx)
+	cancel()
+	select {
+	case sig := <-received:
+		return Interrupted{Signal: sig}
+	default:
+	}
+	return err
+}
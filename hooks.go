@@ -0,0 +1,204 @@
+package cliby
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/coryb/yaml.v2"
+)
+
+// Hook runs before a command, returning an error stops the command from
+// running.
+type Hook func(ctx context.Context, command string) error
+
+// PostHook runs after a command with the error the command returned.  The
+// error returned by a PostHook is only reported when the command succeeded.
+type PostHook func(ctx context.Context, command string, err error) error
+
+// AddPreRunHook adds a hook run before command, or before every command when
+// command is "".  Global hooks run first, then command hooks, in the order
+// they were added.
+func (c *Cli) AddPreRunHook(command string, hook Hook) {
+	if c.preRun == nil {
+		c.preRun = make(map[string][]Hook)
+	}
+	c.preRun[command] = append(c.preRun[command], hook)
+}
+
+// AddPostRunHook adds a hook run after command, or after every command when
+// command is "".  Command hooks run first, then global hooks, in the order
+// they were added.
+func (c *Cli) AddPostRunHook(command string, hook PostHook) {
+	if c.postRun == nil {
+		c.postRun = make(map[string][]PostHook)
+	}
+	c.postRun[command] = append(c.postRun[command], hook)
+}
+
+func (c *Cli) GetPreRunHooks(command string) []Hook {
+	return c.preRun[command]
+}
+
+func (c *Cli) GetPostRunHooks(command string) []PostHook {
+	return c.postRun[command]
+}
+
+// hookRegistry is implemented by Cli, other implementations of Interface
+// only run the hooks from the configs.
+type hookRegistry interface {
+	GetPreRunHooks(string) []Hook
+	GetPostRunHooks(string) []PostHook
+}
+
+func getPreRunHooks(i Interface, command string) []Hook {
+	if registry, ok := i.(hookRegistry); ok {
+		return registry.GetPreRunHooks(command)
+	}
+	return nil
+}
+
+func getPostRunHooks(i Interface, command string) []PostHook {
+	if registry, ok := i.(hookRegistry); ok {
+		return registry.GetPostRunHooks(command)
+	}
+	return nil
+}
+
+// ConfigHook is an entry of the "hooks" section of a config file, run with
+// "sh -c" before or after commands:
+//
+//	hooks:
+//	  pre-run:
+//	    - ./refresh-token
+//	  post-run:
+//	    - run: logger "$NAME_OPERATION exited $NAME_EXIT_STATUS"
+//	      command: issue create
+//
+// Hooks without a command run for every command, otherwise for the command
+// and its subcommands.  The hooks of every config are run, starting with the
+// furthest config, unless a closer config uses "hooks!" to replace them.
+// <NAME>_OPERATION is set to the command, and post-run hooks also get the
+// exit status of the command in <NAME>_EXIT_STATUS.
+type ConfigHook struct {
+	Run     string `json:"run" yaml:"run"`
+	Command string `json:"command" yaml:"command"`
+}
+
+type configHooks struct {
+	PreRun  []ConfigHook `json:"pre-run" yaml:"pre-run"`
+	PostRun []ConfigHook `json:"post-run" yaml:"post-run"`
+}
+
+// loadConfigHooks returns the hooks from the configs, furthest config first.
+func loadConfigHooks(i Interface) configHooks {
+	hooks := configHooks{}
+	for _, config := range configSections(i, "hooks") {
+		decoded, err := decodeConfigHooks(config.data)
+		if err != nil {
+			log.Errorf("Invalid hooks in %s: %s", config.file, err)
+			continue
+		}
+		hooks.PreRun = append(decoded.PreRun, hooks.PreRun...)
+		hooks.PostRun = append(decoded.PostRun, hooks.PostRun...)
+	}
+	return hooks
+}
+
+// decodeConfigHooks decodes a hooks section, where each hook can also be
+// given as just the script to run.
+func decodeConfigHooks(section interface{}) (configHooks, error) {
+	hooks := configHooks{}
+	data, ok := section.(map[string]interface{})
+	if !ok {
+		return hooks, fmt.Errorf("expected pre-run and post-run lists")
+	}
+	for _, key := range []string{"pre-run", "post-run"} {
+		entries, ok := data[key].([]interface{})
+		if data[key] != nil && !ok {
+			return hooks, fmt.Errorf("expected %s to be a list", key)
+		}
+		for n, entry := range entries {
+			if script, ok := entry.(string); ok {
+				entries[n] = map[string]interface{}{"run": script}
+			}
+		}
+	}
+	content, err := yaml.Marshal(data)
+	if err != nil {
+		return hooks, err
+	}
+	err = yaml.Unmarshal(content, &hooks)
+	return hooks, err
+}
+
+func (h ConfigHook) matches(command string) bool {
+	hook := strings.Fields(h.Command)
+	return len(hook) == 0 || strings.HasPrefix(command+" ", strings.Join(hook, " ")+" ")
+}
+
+// PostRunHookTimeout limits how long the post-run hooks of a command can
+// run.  They get a context of their own so they still run after the command
+// was interrupted.
+var PostRunHookTimeout = time.Minute
+
+// runHooks runs the pre-run hooks for command, then run, then the post-run
+// hooks.  Post-run hooks all get the error returned by run, an error from a
+// post-run hook is only returned when run succeeded.
+func runHooks(ctx context.Context, i Interface, command string, run func() error) error {
+	operation := fmt.Sprintf("%s_OPERATION=%s", strings.ToUpper(i.Name()), command)
+	hooks := loadConfigHooks(i)
+
+	for _, hook := range getPreRunHooks(i, "") {
+		if err := hook(ctx, command); err != nil {
+			return err
+		}
+	}
+	for _, hook := range hooks.PreRun {
+		if hook.matches(command) {
+			if err := runScript(ctx, i, hook.Run, getStreams(i), operation); err != nil {
+				return fmt.Errorf("pre-run hook %q failed: %s", hook.Run, err)
+			}
+		}
+	}
+	if command != "" {
+		for _, hook := range getPreRunHooks(i, command) {
+			if err := hook(ctx, command); err != nil {
+				return err
+			}
+		}
+	}
+
+	err := run()
+
+	postCtx, cancel := context.WithTimeout(context.Background(), PostRunHookTimeout)
+	defer cancel()
+	var hookErr error
+	postErr := func(e error) {
+		if e != nil {
+			log.Errorf("post-run hook for %s failed: %s", command, e)
+			if hookErr == nil {
+				hookErr = e
+			}
+		}
+	}
+	if command != "" {
+		for _, hook := range getPostRunHooks(i, command) {
+			postErr(hook(postCtx, command, err))
+		}
+	}
+	status := fmt.Sprintf("%s_EXIT_STATUS=%d", strings.ToUpper(i.Name()), ExitCode(err))
+	for _, hook := range hooks.PostRun {
+		if hook.matches(command) {
+			postErr(runScript(postCtx, i, hook.Run, getStreams(i), operation, status))
+		}
+	}
+	for _, hook := range getPostRunHooks(i, "") {
+		postErr(hook(postCtx, command, err))
+	}
+	if err == nil {
+		return hookErr
+	}
+	return err
+}
@@ -0,0 +1,276 @@
+package cliby
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/coryb/yaml.v2"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	ContentTypeJSON = "application/json"
+	ContentTypeXML  = "application/xml"
+	ContentTypeForm = "application/x-www-form-urlencoded"
+)
+
+func (c *Cli) GetHttpClient() *http.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.httpClient()
+}
+
+func (c *Cli) httpClient() *http.Client {
+	if c.ua == nil {
+		c.ua = &http.Client{}
+	}
+	return c.ua
+}
+
+func (c *Cli) SetHttpClient(client *http.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ua = client
+}
+
+// NewRequest returns a request for uri bound to ctx, with the Content-Type
+// header set when there is a body.
+func (c *Cli) NewRequest(ctx context.Context, method, uri string, body io.Reader, contentType string) (*http.Request, error) {
+	req, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		log.Errorf("Invalid Request: %s", uri)
+		return nil, err
+	}
+	if body != nil && contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req.WithContext(ctx), nil
+}
+
+// Do sends req with the client from GetHttpClient, using the persistent
+// cookie jar unless the client has its own, and the AuthProvider for the
+// host of req, retrying failed requests as GetRetryPolicy allows.  Responses
+// with an error status are returned as is, use DecodeResponse to turn them
+// into a ResponseError.  Set LOG_TRACE to dump requests and responses in the
+// debug log.
+func (c *Cli) Do(req *http.Request) (*http.Response, error) {
+	c.initCookies()
+	return c.retry(req, func(req *http.Request) (*http.Response, error) {
+		return c.authenticate(req, c.send)
+	})
+}
+
+func (c *Cli) send(req *http.Request) (*http.Response, error) {
+	log.Debugf("%s %s", req.Method, req.URL.String())
+	trace := os.Getenv("LOG_TRACE") != "" && log.IsEnabledFor(logging.DEBUG)
+	if trace {
+		if out, err := httputil.DumpRequestOut(req, true); err != nil {
+			log.Debugf("Failed to Dump Request: %s", err)
+		} else {
+			log.Debugf("Request: %s", out)
+		}
+	}
+	resp, err := c.GetHttpClient().Do(req)
+	if trace && resp != nil {
+		if out, err := httputil.DumpResponse(resp, true); err != nil {
+			log.Debugf("Failed to Dump Response: %s", err)
+		} else {
+			log.Debugf("Response: %s", out)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if (resp.StatusCode < 200 || resp.StatusCode >= 300) && resp.StatusCode != 401 {
+		log.Debugf("response status: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func (c *Cli) request(ctx context.Context, method, uri, content, contentType string) (*http.Response, error) {
+	var body io.Reader
+	if content != "" {
+		body = strings.NewReader(content)
+	}
+	req, err := c.NewRequest(ctx, method, uri, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+func (c *Cli) Get(uri string) (*http.Response, error) {
+	return c.GetContext(context.Background(), uri)
+}
+
+func (c *Cli) GetContext(ctx context.Context, uri string) (*http.Response, error) {
+	return c.request(ctx, "GET", uri, "", "")
+}
+
+func (c *Cli) Head(uri string) (*http.Response, error) {
+	return c.HeadContext(context.Background(), uri)
+}
+
+func (c *Cli) HeadContext(ctx context.Context, uri string) (*http.Response, error) {
+	return c.request(ctx, "HEAD", uri, "", "")
+}
+
+func (c *Cli) Post(uri, content string) (*http.Response, error) {
+	return c.PostContext(context.Background(), uri, content)
+}
+
+func (c *Cli) PostContext(ctx context.Context, uri, content string) (*http.Response, error) {
+	return c.request(ctx, "POST", uri, content, ContentTypeJSON)
+}
+
+func (c *Cli) Put(uri, content string) (*http.Response, error) {
+	return c.PutContext(context.Background(), uri, content)
+}
+
+func (c *Cli) PutContext(ctx context.Context, uri, content string) (*http.Response, error) {
+	return c.request(ctx, "PUT", uri, content, ContentTypeJSON)
+}
+
+func (c *Cli) Delete(uri, content string) (*http.Response, error) {
+	return c.DeleteContext(context.Background(), uri, content)
+}
+
+func (c *Cli) DeleteContext(ctx context.Context, uri, content string) (*http.Response, error) {
+	return c.request(ctx, "DELETE", uri, content, ContentTypeJSON)
+}
+
+func (c *Cli) PostXML(uri, content string) (*http.Response, error) {
+	return c.PostXMLContext(context.Background(), uri, content)
+}
+
+func (c *Cli) PostXMLContext(ctx context.Context, uri, content string) (*http.Response, error) {
+	return c.request(ctx, "POST", uri, content, ContentTypeXML)
+}
+
+func (c *Cli) PutXML(uri, content string) (*http.Response, error) {
+	return c.PutXMLContext(context.Background(), uri, content)
+}
+
+func (c *Cli) PutXMLContext(ctx context.Context, uri, content string) (*http.Response, error) {
+	return c.request(ctx, "PUT", uri, content, ContentTypeXML)
+}
+
+// PostForm posts content, an already encoded form such as the result of
+// url.Values.Encode.
+func (c *Cli) PostForm(uri, content string) (*http.Response, error) {
+	return c.PostFormContext(context.Background(), uri, content)
+}
+
+func (c *Cli) PostFormContext(ctx context.Context, uri, content string) (*http.Response, error) {
+	return c.request(ctx, "POST", uri, content, ContentTypeForm)
+}
+
+// GetTimeout is Get with the whole request, including reading the response
+// body, limited to timeout.
+func (c *Cli) GetTimeout(timeout time.Duration, uri string) (*http.Response, error) {
+	return withTimeout(timeout, func(ctx context.Context) (*http.Response, error) {
+		return c.GetContext(ctx, uri)
+	})
+}
+
+// PostTimeout is Post with the whole request, including reading the response
+// body, limited to timeout.
+func (c *Cli) PostTimeout(timeout time.Duration, uri, content string) (*http.Response, error) {
+	return withTimeout(timeout, func(ctx context.Context) (*http.Response, error) {
+		return c.PostContext(ctx, uri, content)
+	})
+}
+
+// cancelBody cancels the context of a request once its response body is
+// closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+func withTimeout(timeout time.Duration, send func(ctx context.Context) (*http.Response, error)) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	resp, err := send(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// RequestJSON sends in encoded as JSON, unless it is nil, and decodes the
+// response into out with DecodeResponse, unless out is nil.
+func (c *Cli) RequestJSON(ctx context.Context, method, uri string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		content, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(content)
+	}
+	req, err := c.NewRequest(ctx, method, uri, body, ContentTypeJSON)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", ContentTypeJSON)
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	return DecodeResponse(resp, out)
+}
+
+func (c *Cli) GetJSON(ctx context.Context, uri string, out interface{}) error {
+	return c.RequestJSON(ctx, "GET", uri, nil, out)
+}
+
+// DecodeResponse reads and closes the body of resp, decoding it into out
+// according to the Content-Type of the response: JSON, XML or YAML.  A
+// response with a non-2xx status returns a ResponseError instead.
+func DecodeResponse(resp *http.Response, out interface{}) error {
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return ResponseError{
+			Method:     resp.Request.Method,
+			URL:        resp.Request.URL.String(),
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       content,
+		}
+	}
+	if out == nil || len(content) == 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "" || mediaType == ContentTypeJSON || strings.HasSuffix(mediaType, "+json"):
+		return json.Unmarshal(content, out)
+	case mediaType == ContentTypeXML || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		return xml.Unmarshal(content, out)
+	case strings.HasSuffix(mediaType, "yaml"):
+		return yaml.Unmarshal(content, out)
+	}
+	return fmt.Errorf("Unable to decode response from %s with Content-Type %q", resp.Request.URL, mediaType)
+}
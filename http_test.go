@@ -0,0 +1,122 @@
+package cliby
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDir changes to a new temporary directory, which also becomes $HOME so
+// cookies and credentials stay out of the real home directory, and writes
+// config to its .test.d/config.yml unless it is empty.  The working
+// directory and $HOME are restored when the test finishes.
+func testDir(t *testing.T, config string) string {
+	t.Helper()
+	dir := t.TempDir()
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", dir)
+	os.Chdir(dir)
+	t.Cleanup(func() {
+		os.Chdir(testRoot)
+		os.Setenv("HOME", home)
+	})
+	os.Mkdir(".test.d", 0755)
+	if config != "" {
+		ioutil.WriteFile(".test.d/config.yml", []byte(config), 0644)
+	}
+	return dir
+}
+
+func TestHttpClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(time.Second)
+		case "/missing":
+			http.Error(w, "no such issue", http.StatusNotFound)
+			return
+		case "/xml":
+			w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+			fmt.Fprintf(w, "<issue><key>%s</key></issue>", body)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"method":       r.Method,
+			"content-type": r.Header.Get("Content-Type"),
+			"body":         string(body),
+		})
+	}))
+	defer server.Close()
+
+	testDir(t, "")
+	cli := New("test")
+	check := func(resp *http.Response, err error, expected map[string]string) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		if err := DecodeResponse(resp, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected %v, got %v", expected, got)
+		}
+	}
+	resp, err := cli.Get(server.URL)
+	check(resp, err, map[string]string{"method": "GET", "content-type": "", "body": ""})
+	resp, err = cli.Post(server.URL, `{"key":"ISSUE-1"}`)
+	check(resp, err, map[string]string{"method": "POST", "content-type": "application/json", "body": `{"key":"ISSUE-1"}`})
+	resp, err = cli.PutXML(server.URL, "<key/>")
+	check(resp, err, map[string]string{"method": "PUT", "content-type": "application/xml", "body": "<key/>"})
+	resp, err = cli.PostForm(server.URL, "key=ISSUE-1")
+	check(resp, err, map[string]string{"method": "POST", "content-type": "application/x-www-form-urlencoded", "body": "key=ISSUE-1"})
+	resp, err = cli.DeleteContext(context.Background(), server.URL, "")
+	check(resp, err, map[string]string{"method": "DELETE", "content-type": "", "body": ""})
+
+	got := map[string]string{}
+	if err := cli.RequestJSON(context.Background(), "PUT", server.URL, map[string]int{"id": 1}, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["body"] != `{"id":1}` || got["content-type"] != "application/json" {
+		t.Errorf("Expected JSON request, got %v", got)
+	}
+
+	issue := struct {
+		Key string `xml:"key"`
+	}{}
+	resp, err = cli.Post(server.URL+"/xml", "ISSUE-2")
+	if err == nil {
+		err = DecodeResponse(resp, &issue)
+	}
+	if err != nil || issue.Key != "ISSUE-2" {
+		t.Errorf("Expected XML response to be decoded, got %v, %v", issue, err)
+	}
+
+	err = cli.GetJSON(context.Background(), server.URL+"/missing", &got)
+	if respErr, ok := err.(ResponseError); !ok || respErr.StatusCode != 404 || string(respErr.Body) != "no such issue\n" {
+		t.Errorf("Expected ResponseError, got %#v", err)
+	}
+
+	if _, err := cli.GetTimeout(50*time.Millisecond, server.URL+"/slow"); err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+	resp, err = cli.GetTimeout(5*time.Second, server.URL)
+	check(resp, err, map[string]string{"method": "GET", "content-type": "", "body": ""})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cli.HeadContext(ctx, server.URL); err == nil {
+		t.Errorf("Expected cancelled request to fail")
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package cliby
+
+import (
+	"os"
+	"sync"
+)
+
+// lockedFiles are the lock files held by this process, on platforms
+// without flock the lock only keeps out other goroutines.
+var lockedFiles = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// tryLockFile marks fh as locked, returning false when it already is.
+func tryLockFile(fh *os.File) (bool, error) {
+	lockedFiles.Lock()
+	defer lockedFiles.Unlock()
+	if lockedFiles.names[fh.Name()] {
+		return false, nil
+	}
+	lockedFiles.names[fh.Name()] = true
+	return true, nil
+}
+
+func unlockFile(fh *os.File) error {
+	lockedFiles.Lock()
+	defer lockedFiles.Unlock()
+	delete(lockedFiles.names, fh.Name())
+	return nil
+}
@@ -0,0 +1,154 @@
+package cliby
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/coryb/cliby.v1/util"
+)
+
+// pluginDirs returns the directories searched for plugins in order of
+// precedence: the closest .<name>.d/plugins directory first, then PATH.
+func pluginDirs(i Interface) []string {
+	dirs := []string{}
+	parents := util.FindParentPaths(fmt.Sprintf(".%s.d/plugins", i.Name()))
+	for n := len(parents) - 1; n >= 0; n-- {
+		dirs = append(dirs, parents[n])
+	}
+	return append(dirs, filepath.SplitList(os.Getenv("PATH"))...)
+}
+
+func isExecutable(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && !stat.IsDir() && stat.Mode()&0111 != 0
+}
+
+// findPlugin returns the path of the <name>-<command> executable for a
+// command, or "" if there is none.
+func findPlugin(i Interface, command string) string {
+	if command == "" || strings.ContainsAny(command, `/\ `) {
+		return ""
+	}
+	for _, dir := range pluginDirs(i) {
+		path := filepath.Join(dir, fmt.Sprintf("%s-%s", i.Name(), command))
+		if isExecutable(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+// FindPlugins returns the path of every plugin by command name.  When a
+// plugin is found in several directories the one that would be run wins.
+func FindPlugins(i Interface) map[string]string {
+	plugins := make(map[string]string)
+	prefix := i.Name() + "-"
+	for _, dir := range pluginDirs(i) {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			name := file.Name()
+			if !strings.HasPrefix(name, prefix) || len(name) == len(prefix) {
+				continue
+			}
+			if _, ok := plugins[name[len(prefix):]]; ok {
+				continue
+			}
+			if path := filepath.Join(dir, name); isExecutable(path) {
+				plugins[name[len(prefix):]] = path
+			}
+		}
+	}
+	return plugins
+}
+
+// bindPlugin adds a kingpin command for the plugin at path that collects
+// every argument after it, and registers a command function running it.
+func bindPlugin(i Interface, app *kingpin.Application, command, path string) {
+	var args []string
+	cmd := app.Command(command, fmt.Sprintf("Run plugin %s", path))
+	cmd.Arg("args", "Plugin arguments").StringsVar(&args)
+	addCommand(i, command, func() error {
+		return RunPlugin(i, path, args)
+	})
+}
+
+// RunPlugin runs the plugin at path with args.  The plugin gets the merged
+// options in the same <NAME>_* environment variables populateEnv exports,
+// and as JSON in the file named by <NAME>_OPTIONS_FILE.  A plugin that exits
+// non-zero returns an Exit with its exit status.
+func RunPlugin(i Interface, path string, args []string) error {
+	optionsFile, err := ioutil.TempFile("", fmt.Sprintf("%s-options-*.json", i.Name()))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(optionsFile.Name())
+	err = json.NewEncoder(optionsFile).Encode(i.GetOptions())
+	optionsFile.Close()
+	if err != nil {
+		return err
+	}
+
+	populateEnv(i)
+	streams := getStreams(i)
+	cmd := exec.Command(path, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = streams.In, streams.Out, streams.Err
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s_OPTIONS_FILE=%s", strings.ToUpper(i.Name()), optionsFile.Name()))
+	log.Debugf("Running plugin %s %q", path, args)
+	return exitStatus(cmd.Run())
+}
+
+// exitStatus turns a non-zero exit status from a command into an Exit.
+func exitStatus(err error) error {
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+		return Exit{Code: exitErr.ExitCode()}
+	}
+	return err
+}
+
+// pluginArgs returns the arguments following command in os.Args, for
+// plugins run by RunCommand without ProcessAllOptions.
+func pluginArgs(command string) []string {
+	for n, arg := range os.Args[1:] {
+		if arg == command {
+			return os.Args[n+2:]
+		}
+	}
+	return nil
+}
+
+// AddPluginsCommand registers the built-in "plugins list" command on app.
+// Like AddConfigCommand it is opt-in, call it from CommandLine().
+func AddPluginsCommand(i Interface, app *kingpin.Application) {
+	cmd := app.Command("plugins", "Manage external plugin commands")
+	cmd.Command("list", "List the plugins found in the plugin directories and PATH")
+	addHandler(i, "plugins list", func(ctx context.Context, options interface{}, streams IOStreams) error {
+		return ListPlugins(i, streams.Out)
+	})
+}
+
+func ListPlugins(i Interface, out io.Writer) error {
+	plugins := FindPlugins(i)
+	names := make([]string, 0, len(plugins))
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(out, "%s\t%s\n", name, plugins[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
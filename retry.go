@@ -0,0 +1,251 @@
+package cliby
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gopkg.in/coryb/yaml.v2"
+)
+
+// RetryPolicy retries idempotent requests, or requests with an
+// Idempotency-Key header, that fail with a connection error, a 5xx status
+// other than 501 Not Implemented, 429 Too Many Requests, or 403 Forbidden
+// with an exhausted rate limit, up to MaxRetries times.
+//
+// The wait before retry n is MinBackoff doubled n-1 times, at most
+// MaxBackoff, with up to half of it replaced by random jitter.  When the
+// server asks to wait longer with Retry-After, or with X-RateLimit-Reset
+// once X-RateLimit-Remaining is 0, its wait is used instead, unless it is
+// longer than MaxWait, in which case the response is returned.  Until an
+// exhausted rate limit resets, further requests to the same host wait for
+// it too.
+type RetryPolicy struct {
+	MaxRetries int           `json:"max-retries" yaml:"max-retries"`
+	MinBackoff time.Duration `json:"min-backoff" yaml:"min-backoff"`
+	MaxBackoff time.Duration `json:"max-backoff" yaml:"max-backoff"`
+	MaxWait    time.Duration `json:"max-wait" yaml:"max-wait"`
+}
+
+// DefaultRetryPolicy fills in the settings missing from the "retry" section
+// of a config file.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 3,
+	MinBackoff: 500 * time.Millisecond,
+	MaxBackoff: 30 * time.Second,
+	MaxWait:    5 * time.Minute,
+}
+
+// SetRetryPolicy sets the policy used to retry failed requests, nil turns
+// retries off.
+func (c *Cli) SetRetryPolicy(policy *RetryPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retryPolicy = policy
+	c.retryConfigured = true
+}
+
+// GetRetryPolicy returns the policy set with SetRetryPolicy, or the policy
+// from the "retry" section of the closest config:
+//
+//	retry:
+//	  max-retries: 5
+//	  min-backoff: 1s
+//
+// Requests are not retried when there is neither.
+func (c *Cli) GetRetryPolicy() *RetryPolicy {
+	c.mu.Lock()
+	policy, configured := c.retryPolicy, c.retryConfigured
+	c.mu.Unlock()
+	if configured {
+		return policy
+	}
+	policy = loadConfigRetryPolicy(c)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.retryConfigured {
+		c.retryPolicy, c.retryConfigured = policy, true
+	}
+	return c.retryPolicy
+}
+
+func loadConfigRetryPolicy(i Interface) *RetryPolicy {
+	sections := configSections(i, "retry")
+	if len(sections) == 0 {
+		return nil
+	}
+	policy := DefaultRetryPolicy
+	content, err := yaml.Marshal(sections[0].data)
+	if err == nil {
+		err = yaml.Unmarshal(content, &policy)
+	}
+	if err != nil {
+		log.Errorf("Invalid retry in %s: %s", sections[0].file, err)
+		return nil
+	}
+	return &policy
+}
+
+var idempotentMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PUT":     true,
+	"DELETE":  true,
+}
+
+func (p *RetryPolicy) retryable(req *http.Request) bool {
+	if req.Body != nil && req.GetBody == nil {
+		// the body cannot be sent again
+		return false
+	}
+	return idempotentMethods[req.Method] || req.Header.Get("Idempotency-Key") != ""
+}
+
+func (p *RetryPolicy) shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented) ||
+		(resp.StatusCode == http.StatusForbidden && !rateLimitReset(resp).IsZero())
+}
+
+// backoff returns the wait before retry number attempt, starting at 1.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.MinBackoff
+	for n := 1; n < attempt && wait < p.MaxBackoff; n++ {
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if wait <= 0 {
+		return 0
+	}
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// retryAfter returns how long resp asks to wait before sending another
+// request, 0 when it does not say.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	if value := resp.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return date.Sub(now)
+		}
+	}
+	if reset := rateLimitReset(resp); !reset.IsZero() {
+		return reset.Sub(now)
+	}
+	return 0
+}
+
+// rateLimitReset returns when the rate limit exhausted by resp resets, or
+// the zero time when the limit is not exhausted.  X-RateLimit-Reset is
+// either a Unix time, or the number of seconds until the reset.
+func rateLimitReset(resp *http.Response) time.Time {
+	if resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		return time.Time{}
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	if reset < 1000000000 {
+		return time.Now().Add(time.Duration(reset) * time.Second)
+	}
+	return time.Unix(reset, 0)
+}
+
+// retry sends req, sending it again as the retry policy allows.
+func (c *Cli) retry(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	policy := c.GetRetryPolicy()
+	if policy == nil {
+		return send(req)
+	}
+	ctx := req.Context()
+	if wait := time.Until(c.rateLimitReset(req.URL.Host)); wait > 0 && wait <= policy.MaxWait {
+		log.Debugf("Rate limit for %s exhausted, waiting %s", req.URL.Host, wait)
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := send(req)
+		if err == nil {
+			c.setRateLimitReset(req.URL.Host, rateLimitReset(resp))
+		}
+		if attempt > policy.MaxRetries || ctx.Err() != nil || !policy.retryable(req) || !policy.shouldRetry(resp, err) {
+			return resp, err
+		}
+
+		wait := policy.backoff(attempt)
+		if resp != nil {
+			if after := retryAfter(resp, time.Now()); after > policy.MaxWait {
+				log.Debugf("Not retrying %s %s, server asked to wait %s", req.Method, req.URL.String(), after)
+				return resp, err
+			} else if after > wait {
+				wait = after
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			log.Debugf("Retrying %s %s in %s after %s", req.Method, req.URL.String(), wait, resp.Status)
+		} else {
+			log.Debugf("Retrying %s %s in %s after %s", req.Method, req.URL.String(), wait, err)
+		}
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, err
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+	}
+}
+
+// rateLimitReset returns when the exhausted rate limit of host resets, the
+// zero time when it is not exhausted.
+func (c *Cli) rateLimitReset(host string) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rateLimits[host]
+}
+
+func (c *Cli) setRateLimitReset(host string, reset time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if reset.IsZero() {
+		delete(c.rateLimits, host)
+		return
+	}
+	if c.rateLimits == nil {
+		c.rateLimits = make(map[string]time.Time)
+	}
+	c.rateLimits[host] = reset
+}
+
+func sleepContext(ctx context.Context, wait time.Duration) error {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
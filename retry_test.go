@@ -0,0 +1,204 @@
+package cliby
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	attempts := map[string]int{}
+	bodies := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts[r.URL.Path]++
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		switch r.URL.Path {
+		case "/flaky":
+			if attempts[r.URL.Path]%3 != 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "/down":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case "/unimplemented":
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		case "/busy":
+			w.Header().Set("Retry-After", "600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		case "/limited":
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			if attempts[r.URL.Path] == 1 {
+				w.Header().Set("X-RateLimit-Reset", "0")
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		}
+		fmt.Fprintf(w, "attempt %d", attempts[r.URL.Path])
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	testDir(t, "")
+	cli := New("test")
+	cli.SetCookieFile("")
+	if cli.GetRetryPolicy() != nil {
+		t.Errorf("Expected no retries without a retry policy")
+	}
+	ioutil.WriteFile(".test.d/config.yml", []byte(`
+retry:
+  max-retries: 1
+  min-backoff: 1ms
+`), 0644)
+	cli = New("test")
+	cli.SetCookieFile("")
+	expected := &RetryPolicy{MaxRetries: 1, MinBackoff: time.Millisecond, MaxBackoff: DefaultRetryPolicy.MaxBackoff, MaxWait: DefaultRetryPolicy.MaxWait}
+	if policy := cli.GetRetryPolicy(); !reflect.DeepEqual(policy, expected) {
+		t.Errorf("Expected retry policy from config %#v, got %#v", expected, policy)
+	}
+	os.Mkdir(".test.d/config.d", 0755)
+	ioutil.WriteFile(".test.d/config.d/10-retry.yml", []byte("retry!: null\n"), 0644)
+	if policy := New("test").GetRetryPolicy(); policy != nil {
+		t.Errorf("Expected retry! to turn retries off, got %#v", policy)
+	}
+	os.Remove(".test.d/config.d/10-retry.yml")
+	cli.SetRetryPolicy(&RetryPolicy{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond, MaxWait: time.Second})
+
+	check := func(resp *http.Response, err error, path string, status, count int) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status || attempts[path] != count {
+			t.Errorf("%s: Expected status %d after %d attempts, got %d after %d", path, status, count, resp.StatusCode, attempts[path])
+		}
+		attempts[path] = 0
+	}
+	resp, err := cli.Get(server.URL + "/flaky")
+	check(resp, err, "/flaky", 200, 3)
+	bodies = nil
+	resp, err = cli.Put(server.URL+"/flaky", "{}")
+	check(resp, err, "/flaky", 200, 3)
+	if !reflect.DeepEqual(bodies, []string{"{}", "{}", "{}"}) {
+		t.Errorf("Expected the body to be sent with every attempt, got %q", bodies)
+	}
+	resp, err = cli.Post(server.URL+"/flaky", "{}")
+	check(resp, err, "/flaky", 503, 1)
+	req, _ := cli.NewRequest(context.Background(), "POST", server.URL+"/flaky", strings.NewReader("{}"), ContentTypeJSON)
+	req.Header.Set("Idempotency-Key", "1")
+	resp, err = cli.Do(req)
+	check(resp, err, "/flaky", 200, 3)
+	resp, err = cli.Get(server.URL + "/down")
+	check(resp, err, "/down", 500, 4)
+	resp, err = cli.Get(server.URL + "/unimplemented")
+	check(resp, err, "/unimplemented", 501, 1)
+	resp, err = cli.Get(server.URL + "/busy")
+	check(resp, err, "/busy", 429, 1)
+
+	resp, err = cli.Get(server.URL + "/limited")
+	check(resp, err, "/limited", 200, 2)
+	if reset := cli.rateLimits[host]; time.Until(reset) < 59*time.Minute {
+		t.Errorf("Expected exhausted rate limit to be recorded, got %s", reset)
+	}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	if _, err := cli.Get(closed.URL); err == nil {
+		t.Errorf("Expected connection error")
+	}
+
+	now := time.Now().Truncate(time.Second)
+	header := func(pairs ...string) *http.Response {
+		resp := &http.Response{Header: http.Header{}}
+		for n := 0; n < len(pairs); n += 2 {
+			resp.Header.Set(pairs[n], pairs[n+1])
+		}
+		return resp
+	}
+	for _, test := range []struct {
+		resp     *http.Response
+		expected time.Duration
+	}{
+		{header("Retry-After", "120"), 2 * time.Minute},
+		{header("Retry-After", now.Add(time.Hour).UTC().Format(http.TimeFormat)), time.Hour},
+		{header("X-RateLimit-Remaining", "0", "X-RateLimit-Reset", strconv.FormatInt(now.Add(time.Minute).Unix(), 10)), time.Minute},
+		{header("X-RateLimit-Remaining", "5", "X-RateLimit-Reset", "60"), 0},
+		{header(), 0},
+	} {
+		if got := retryAfter(test.resp, now); got != test.expected {
+			t.Errorf("Expected to wait %s for %v, got %s", test.expected, test.resp.Header, got)
+		}
+	}
+
+	policy := RetryPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		if wait := policy.backoff(attempt + 1); wait < max/2 || wait > max {
+			t.Errorf("Expected backoff for attempt %d between %s and %s, got %s", attempt+1, max/2, max, wait)
+		}
+	}
+}
+
+// TestRetryPolicyParallel is meant to be run with -race, see "make race".
+func TestRetryPolicyParallel(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1)%2 == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	testDir(t, `
+retry:
+  max-retries: 10
+  min-backoff: 1ms
+  max-backoff: 2ms
+`)
+
+	cli := New("test")
+	cli.SetCookieFile("")
+	errs := make(chan error, 20)
+	var wg sync.WaitGroup
+	for n := 0; n < cap(errs); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := cli.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode != 200 {
+					err = fmt.Errorf("unexpected status %s", resp.Status)
+				}
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
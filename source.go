@@ -0,0 +1,156 @@
+package cliby
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+type SourceKind string
+
+const (
+	SourceDefaults    SourceKind = "defaults"
+	SourceCommandLine SourceKind = "command-line"
+	SourceEnv         SourceKind = "env"
+	SourceFile        SourceKind = "file"
+	SourceExec        SourceKind = "exec"
+)
+
+// ConfigSource describes where an option value came from.  File is only set
+// for values loaded from config files or executable configs, and Env for
+// values loaded from environment variables.
+type ConfigSource struct {
+	Kind SourceKind
+	File string
+	Env  string
+}
+
+func (s ConfigSource) String() string {
+	if s.File != "" {
+		return fmt.Sprintf("%s %s", s.Kind, s.File)
+	}
+	if s.Env != "" {
+		return fmt.Sprintf("%s %s", s.Kind, s.Env)
+	}
+	return string(s.Kind)
+}
+
+// GetSources returns the source recorded for every key path set while
+// merging options.  Key paths are dotted config keys, with list elements
+// appended by a merge addressed as key[index].
+func (c *Cli) GetSources() map[string]ConfigSource {
+	return c.sources
+}
+
+func (c *Cli) SetSource(key string, source ConfigSource) {
+	if c.sources == nil {
+		c.sources = make(map[string]ConfigSource)
+	}
+	c.sources[key] = source
+}
+
+// GetSource returns the source that supplied the value at key.  If key was
+// not set directly (e.g. it lives inside a map that was set as a whole) the
+// closest recorded parent key is used.
+func (c *Cli) GetSource(key string) (ConfigSource, bool) {
+	return lookupSource(c.sources, key)
+}
+
+// sourceTracker is implemented by Cli to record the source of every merged
+// option, other implementations of Interface are merged without sources.
+type sourceTracker interface {
+	GetSources() map[string]ConfigSource
+	SetSource(string, ConfigSource)
+}
+
+func getSources(i Interface) map[string]ConfigSource {
+	if tracker, ok := i.(sourceTracker); ok {
+		return tracker.GetSources()
+	}
+	return nil
+}
+
+func setSource(i Interface, key string, source ConfigSource) {
+	if tracker, ok := i.(sourceTracker); ok {
+		tracker.SetSource(key, source)
+	}
+}
+
+// sourceRecorder returns the SetSource method of i for a merger, or nil
+// when i does not track sources.
+func sourceRecorder(i Interface) func(string, ConfigSource) {
+	if tracker, ok := i.(sourceTracker); ok {
+		return tracker.SetSource
+	}
+	return nil
+}
+
+// GetConfigPaths returns every config file candidate LoadConfigs searched,
+// in the order they were merged from lowest to highest precedence,
+// including candidates that did not exist.
+func (c *Cli) GetConfigPaths() []string {
+	return c.searched
+}
+
+func (c *Cli) SetConfigPaths(paths []string) {
+	c.searched = paths
+}
+
+// configPathTracker is implemented by Cli to remember the config paths
+// searched for ExplainConfig.
+type configPathTracker interface {
+	GetConfigPaths() []string
+	SetConfigPaths([]string)
+}
+
+func getConfigPaths(i Interface) []string {
+	if tracker, ok := i.(configPathTracker); ok {
+		return tracker.GetConfigPaths()
+	}
+	return nil
+}
+
+func setConfigPaths(i Interface, paths []string) {
+	if tracker, ok := i.(configPathTracker); ok {
+		tracker.SetConfigPaths(paths)
+	}
+}
+
+func lookupSource(sources map[string]ConfigSource, key string) (ConfigSource, bool) {
+	for key != "" {
+		if source, ok := sources[key]; ok {
+			return source, true
+		}
+		key = parentKey(key)
+	}
+	return ConfigSource{}, false
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return fmt.Sprintf("%s.%s", prefix, key)
+}
+
+func indexKey(prefix string, index int) string {
+	return fmt.Sprintf("%s[%d]", prefix, index)
+}
+
+func parentKey(key string) string {
+	if i := strings.LastIndexAny(key, ".["); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+// fieldKey returns the config key used for a struct field, preferring the
+// yaml tag, then the json tag, then the lowercased field name like yaml does.
+func fieldKey(field reflect.StructField) string {
+	for _, tag := range []string{"yaml", "json"} {
+		if name := strings.Split(field.Tag.Get(tag), ",")[0]; name != "" && name != "-" {
+			return name
+		}
+	}
+	return strings.ToLower(field.Name)
+}
@@ -0,0 +1,85 @@
+package cliby
+
+import (
+	"reflect"
+	"strings"
+)
+
+// clibyTag holds the settings from a `cliby:"..."` struct tag.  Settings are
+// comma separated and either bare names like "required" or key=value pairs
+// like "merge=append".  Values containing commas can be single quoted, as in
+// help='Name, or id, of the project'.  A tag of "-" skips the field.
+type clibyTag map[string]string
+
+func parseClibyTag(field reflect.StructField) clibyTag {
+	tag := clibyTag{}
+	value := field.Tag.Get("cliby")
+	if value == "-" {
+		tag["-"] = ""
+		return tag
+	}
+	for value != "" {
+		var item string
+		quoted := false
+		i := 0
+		for ; i < len(value); i++ {
+			if value[i] == '\'' {
+				quoted = !quoted
+			} else if value[i] == ',' && !quoted {
+				break
+			}
+		}
+		item, value = value[:i], strings.TrimPrefix(value[i:], ",")
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) == 1 {
+			tag[key] = ""
+			continue
+		}
+		val := strings.TrimSpace(parts[1])
+		if len(val) >= 2 && val[0] == '\'' && val[len(val)-1] == '\'' {
+			val = val[1 : len(val)-1]
+		}
+		tag[key] = val
+	}
+	return tag
+}
+
+func (t clibyTag) Get(key string) string {
+	return t[key]
+}
+
+func (t clibyTag) Has(key string) bool {
+	_, ok := t[key]
+	return ok
+}
+
+func (t clibyTag) Skip() bool {
+	return t.Has("-")
+}
+
+// Merge strategies for the `cliby:"merge=..."` struct tag.  Sources are
+// merged from highest precedence (command line, closest config) to lowest
+// (defaults).
+const (
+	// MergeFirst keeps the value from the highest precedence source that
+	// sets the field, so the closest config wins.  Maps and slices are taken
+	// whole instead of being deep merged.  This is the default for scalars.
+	MergeFirst = "first"
+	// MergeReplace behaves exactly like MergeFirst.  It is meant for maps and
+	// slices, where it reads as replacing the default deep merge.
+	MergeReplace = "replace"
+	// MergeLast keeps the value from the lowest precedence config or default
+	// that sets the field.  A value from the command line or the environment
+	// still wins over every config.
+	MergeLast = "last"
+	// MergeUnion appends slice values not already present.  This is the
+	// default for slices.
+	MergeUnion = "union"
+	// MergeAppend appends every slice value in precedence order without
+	// removing duplicates.
+	MergeAppend = "append"
+)
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"errors"
@@ -14,6 +15,7 @@ import (
 	"time"
 
 	"github.com/bmatcuk/doublestar"
+	"github.com/kballard/go-shellquote"
 	"github.com/mgutz/ansi"
 	"github.com/op/go-logging"
 	"gopkg.in/coryb/yaml.v2"
@@ -21,7 +23,9 @@ import (
 
 var log = logging.MustGetLogger("util")
 
-func FindParentPaths(fileName string) []string {
+// ParentPaths returns every location FindParentPaths checks for fileName,
+// whether or not it exists.
+func ParentPaths(fileName string) []string {
 	cwd, _ := os.Getwd()
 
 	paths := make([]string, 0)
@@ -29,10 +33,7 @@ func FindParentPaths(fileName string) []string {
 	// special case if homedir is not in current path then check there anyway
 	homedir := os.Getenv("HOME")
 	if !strings.HasPrefix(cwd, homedir) {
-		file := fmt.Sprintf("%s/%s", homedir, fileName)
-		if _, err := os.Stat(file); err == nil {
-			paths = append(paths, file)
-		}
+		paths = append(paths, fmt.Sprintf("%s/%s", homedir, fileName))
 	}
 
 	var dir string
@@ -42,7 +43,14 @@ func FindParentPaths(fileName string) []string {
 		} else {
 			dir = fmt.Sprintf("%s/%s", dir, part)
 		}
-		file := fmt.Sprintf("%s/%s", dir, fileName)
+		paths = append(paths, fmt.Sprintf("%s/%s", dir, fileName))
+	}
+	return paths
+}
+
+func FindParentPaths(fileName string) []string {
+	paths := make([]string, 0)
+	for _, file := range ParentPaths(fileName) {
 		if _, err := os.Stat(file); err == nil {
 			paths = append(paths, file)
 		}
@@ -210,6 +218,7 @@ func RunTemplate(templateContent string, data interface{}, out io.Writer) error
 		"cwd": func() (string, error) {
 			return os.Getwd()
 		},
+		"shellquote": ShellQuote,
 		"findLatestFile": func(glob string) (string, error) {
 			matches, err := doublestar.Glob(glob)
 			if err != nil {
@@ -250,6 +259,15 @@ func RunTemplate(templateContent string, data interface{}, out io.Writer) error
 	return nil
 }
 
+// ShellQuote quotes value for use as a single word in a shell script, a
+// list as one word per element.
+func ShellQuote(value interface{}) string {
+	if values, ok := value.([]string); ok {
+		return shellquote.Join(values...)
+	}
+	return shellquote.Join(fmt.Sprint(value))
+}
+
 func ResponseToJson(resp *http.Response, err error) (interface{}, error) {
 	if err != nil {
 		return nil, err
@@ -328,17 +346,17 @@ func JsonWrite(file string, data interface{}) {
 // 	return strings.TrimSpace(out)
 // }
 
-// func PromptWithDefault(prompt string, defaultValue string) string {
-// 	reader := bufio.NewReader(os.Stdin)
-// 	prompt = fmt.Sprintf("%s [%s]: ", prompt, defaultValue)
-// 	fmt.Printf("%s", prompt)
-// 	out, _ := reader.ReadString('\n')
-// 	if len(strings.TrimSpace(out)) == 0 {
-// 		return defaultValue
-// 	} else {
-// 		return strings.TrimSpace(out)
-// 	}
-// }
+func PromptWithDefault(prompt string, defaultValue string) string {
+	reader := bufio.NewReader(os.Stdin)
+	prompt = fmt.Sprintf("%s [%s]: ", prompt, defaultValue)
+	fmt.Printf("%s", prompt)
+	out, _ := reader.ReadString('\n')
+	if len(strings.TrimSpace(out)) == 0 {
+		return defaultValue
+	} else {
+		return strings.TrimSpace(out)
+	}
+}
 
 func ParseYaml(file string, opts *map[string]interface{}) {
 	if fh, err := ioutil.ReadFile(file); err == nil {
@@ -416,3 +434,37 @@ func Mkdir(dir string) error {
 	}
 	return nil
 }
+
+// EditDistance returns the Levenshtein distance between a and b, the number
+// of single character insertions, deletions or substitutions to turn a into
+// b.
+func EditDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur := make([]int, len(br)+1)
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(br)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -53,3 +53,38 @@ func TestRunTemplateCwd(t *testing.T) {
 		t.Errorf("Expected %v but recieved %v", wd, buf.String())
 	}
 }
+
+func TestShellQuote(t *testing.T) {
+	var buf bytes.Buffer
+	data := map[string]interface{}{
+		"word":  "it's $(rm -rf /) `x`",
+		"words": []string{"a b", ""},
+		"flag":  true,
+	}
+	if err := RunTemplate("{{shellquote .word}} {{shellquote .words}} {{shellquote .flag}}", data, &buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `'it'\''s $(rm -rf /) ` + "`x`" + `' 'a b' '' true`
+	if buf.String() != expected {
+		t.Errorf("Expected %v but recieved %v", expected, buf.String())
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		distance int
+	}{
+		{"", "", 0},
+		{"create", "create", 0},
+		{"craete", "create", 2},
+		{"lsit", "list", 2},
+		{"delet", "delete", 1},
+		{"", "abc", 3},
+		{"kitten", "sitting", 3},
+	} {
+		if got := EditDistance(test.a, test.b); got != test.distance {
+			t.Errorf("Expected distance %d between %q and %q, got %d", test.distance, test.a, test.b, got)
+		}
+	}
+}